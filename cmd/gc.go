@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"github.com/v4run/reversepf/internal/k8s"
+)
+
+var (
+	dryRun      bool
+	waitTimeout time.Duration
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete the expired sessions in the k8s cluster",
+	Long: `Deletes the sessions whose local component has not been seen for longer than their ttl, for example because the machine running it crashed.
+Sessions intercepting a service get the selector of the service restored.`,
+	Run: func(_ *cobra.Command, _ []string) {
+		ctx := context.Background()
+		deployer := k8s.NewDeployer(k8s.Config{
+			AppName:     AppName,
+			Kubeconfig:  kubeconfig,
+			KubeContext: kubeContext,
+		})
+		sessions, err := deployer.ListSessions(ctx)
+		if err != nil {
+			log.Error("Error listing sessions", "err", err)
+			return
+		}
+		now := time.Now()
+		expired := 0
+		for _, session := range sessions {
+			if !session.Expired(now) {
+				log.Debug("Session not expired", "name", session.Name, "namespace", session.Namespace, "lastSeen", session.LastSeen())
+				continue
+			}
+			expired++
+			log.Info(
+				"Deleting expired session",
+				"name", session.Name,
+				"namespace", session.Namespace,
+				"owner", session.Owner,
+				"host", session.Host,
+				"lastSeen", session.LastSeen().Local().Format(time.DateTime),
+				"dryRun", dryRun,
+			)
+			if dryRun {
+				continue
+			}
+			deleteCtx, cancel := context.WithTimeout(ctx, waitTimeout)
+			deployer.DeleteSession(deleteCtx, session)
+			cancel()
+		}
+		log.Info("Garbage collection completed", "sessions", len(sessions), "expired", expired)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "Only show the expired sessions without deleting them")
+	gcCmd.Flags().DurationVarP(&waitTimeout, "wait-timeout", "", time.Minute, "How long to wait for the namespace of each session to be deleted")
+	gcCmd.Flags().StringVarP(&kubeContext, "context", "", "", "The name of the kubeconfig context to use")
+	addKubeconfigFlag(gcCmd)
+}
@@ -2,15 +2,22 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
-	"syscall"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
+	"github.com/v4run/reversepf/internal/certs"
 	"github.com/v4run/reversepf/internal/k8s"
 	"github.com/v4run/reversepf/internal/local"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/proxyproto"
+	"github.com/v4run/reversepf/internal/remote"
+	"github.com/v4run/reversepf/internal/shutdown"
 	"github.com/v4run/reversepf/utils"
 	"github.com/v4run/reversepf/version"
 	"k8s.io/apimachinery/pkg/util/rand"
@@ -22,73 +29,268 @@ const (
 )
 
 var (
-	kubeContext string
-	kubeconfig  string
-	name        string
+	kubeContext     string
+	kubeconfig      string
+	name            string
+	enableTLS       bool
+	servicePort     string
+	fallbackService string
+	intercept       string
+	targetNamespace string
+	proxyProtocol   string
+	readyTimeout    time.Duration
+	remoteLogs      string
+	shutdownTimeout time.Duration
+	drainTimeout    time.Duration
+	ttl             time.Duration
+	takeover        bool
+	healthPort      string
 )
 
 // k8sCmd represents the k8s command
 var k8sCmd = &cobra.Command{
 	Use:   "k8s",
 	Short: "The local part for k8s remote",
-	Long:  `The part creates a new deployment, service and pod in the remote k8s. Then the control-server-port and portal-port ports are port forwarded to local.`,
+	Long: `The part creates a new deployment, service and pod in the remote k8s. Then the control-server-port is port forwarded to local.
+With --intercept, the deployment is created next to an existing service and the service is pointed at it instead.`,
 	Run: func(_ *cobra.Command, _ []string) {
-		ctx := context.Background()
-		if servicePort == "" {
-			servicePort = localPort
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if _, err := remote.ParseFailureAction(onUnavailable); err != nil {
+			log.Error("Invalid on-unavailable", "err", err)
+			return
+		}
+		if _, err := remote.ParseUpstreams(upstreamSpecs); err != nil {
+			log.Error("Invalid upstream", "err", err)
+			return
 		}
-		ports, err := utils.GetRandomOpenPort(2)
+		if routeHeader != "" {
+			if _, err := remote.ParseRoute(routeHeader); err != nil {
+				log.Error("Invalid route-header", "err", err)
+				return
+			}
+			if len(upstreamSpecs) == 0 && fallbackService == "" {
+				log.Error("route-header requires an upstream or a fallback-service for the requests which do not match")
+				return
+			}
+		}
+		mirror, err := remote.ParseMirrorMode(mirrorMode)
 		if err != nil {
-			log.Error("Error getting random open ports", "err", err)
+			log.Error("Invalid mirror", "err", err)
+			return
+		}
+		if mirror != remote.MirrorOff {
+			if routeHeader != "" {
+				log.Error("route-header and mirror cannot be used together")
+				return
+			}
+			if len(upstreamSpecs) == 0 && fallbackService == "" {
+				log.Error("mirror requires an upstream or a fallback-service to serve the connections")
+				return
+			}
+		}
+		if _, err := proxyproto.ParseVersion(proxyProtocol); err != nil {
+			log.Error("Invalid proxy-protocol", "err", err)
 			return
 		}
+		if _, err := k8s.ParseLogMode(remoteLogs); err != nil {
+			log.Error("Invalid remote-logs", "err", err)
+			return
+		}
+		mappings, err := mapping.ParseAll(localPorts)
+		if err != nil {
+			log.Error("Invalid local-port", "err", err)
+			return
+		}
+		var interceptService string
+		if intercept != "" {
+			if interceptService, err = k8s.ParseInterceptTarget(intercept); err != nil {
+				log.Error("Invalid intercept", "err", err)
+				return
+			}
+			if exposeControl {
+				log.Warn("expose-control-server is ignored while intercepting a service")
+				exposeControl = false
+			}
+		} else if targetNamespace != "" {
+			log.Error("namespace can only be used with intercept")
+			return
+		}
+		if selfDestruct && idleTimeout <= 0 {
+			log.Error("self-destruct requires an idle-timeout")
+			return
+		}
+		if idleTimeout > 0 && !selfDestruct {
+			log.Error("idle-timeout requires self-destruct, as the deployment would only restart the remote component")
+			return
+		}
+		if servicePort != "" {
+			if len(mappings) != 1 {
+				log.Error("service-port can only be used with a single local-port")
+				return
+			}
+			port, _, err := mapping.ParseServicePort(servicePort)
+			if err != nil {
+				log.Error("Invalid service-port", "err", err)
+				return
+			}
+			mappings[0].ServicePort = port
+		}
 		if controlServerPort == "" {
+			ports, err := utils.GetRandomOpenPort(1)
+			if err != nil {
+				log.Error("Error getting random open ports", "err", err)
+				return
+			}
 			controlServerPort = ports[0]
 		}
-		if portalPort == "" {
-			portalPort = ports[1]
-		}
 		if name == "" {
 			name = rand.String(8)
 		}
+		token, err := utils.GenerateToken()
+		if err != nil {
+			log.Error("Error generating session token", "err", err)
+			return
+		}
+		var (
+			tlsBundle *certs.Bundle
+			tlsConfig *tls.Config
+		)
+		if enableTLS {
+			bundle, err := certs.Generate(AppName)
+			if err != nil {
+				log.Error("Error generating tls certificates", "err", err)
+				return
+			}
+			tlsConfig, err = certs.ClientConfig(bundle.ClientCert, bundle.ClientKey, bundle.CA, AppName)
+			if err != nil {
+				log.Error("Error loading tls certificates", "err", err)
+				return
+			}
+			tlsBundle = &bundle
+		}
 		namespace := fmt.Sprintf("%s-%s", AppName, name)
-		k8sConfig := k8s.Config{
-			AppName:           AppName,
-			Namespace:         namespace,
-			Version:           version.Version,
-			ControlServerPort: controlServerPort,
-			PortalPort:        portalPort,
-			ServicePort:       servicePort,
-			Kubeconfig:        kubeconfig,
-			KubeContext:       kubeContext,
+		if interceptService != "" {
+			namespace = targetNamespace
 		}
+		manager := shutdown.NewManager(shutdownTimeout)
+		k8sConfig := newK8sConfig(namespace, mappings, token, tlsBundle, mirror, interceptService)
+		k8sConfig.Spawn = manager.Go
 		deployer := k8s.NewDeployer(k8sConfig)
-		utils.HandleSignals(func() {
-			deployer.Cleanup(ctx)
-			os.Exit(0)
-		}, syscall.SIGINT)
+		manager.OnShutdown("cleanup", func(shutdownCtx context.Context) {
+			// stops port forwarding and the remote logs before the remote resources go away
+			cancel()
+			deployer.Cleanup(shutdownCtx)
+		})
+		manager.HandleSignals()
+		defer manager.Recover()
 		if err := deployer.Deploy(ctx); err != nil {
 			log.Error("Error setting up remote components", "err", err)
-			return
+			manager.Shutdown(1)
+		}
+		localComponent := local.NewLocalComponent(deployer.Mappings(), controlServerPort, token, tlsConfig, proxyProtocol, manager.Go)
+		manager.OnShutdown("drain", func(shutdownCtx context.Context) {
+			drainCtx, cancel := context.WithTimeout(shutdownCtx, drainTimeout)
+			defer cancel()
+			localComponent.Drain(drainCtx)
+		})
+		if err := localComponent.Start(); err != nil {
+			log.Error("Error running local component", "err", err)
+			manager.Shutdown(1)
 		}
-		localComponent := local.NewLocalComponent(localPort, portalPort, controlServerPort)
-		localComponent.Start()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(k8sCmd)
-	k8sCmd.Flags().StringVarP(&localPort, "local-port", "l", "", "Local port to be forwarded")
-	k8sCmd.Flags().StringVarP(&portalPort, "portal-port", "p", "", "The portal-port in remote server")
+	k8sCmd.Flags().StringArrayVarP(&localPorts, "local-port", "l", nil, "Local target to be forwarded, as TARGET[:SERVICE_PORT][/PROTOCOL]. TARGET is a local port, a HOST:PORT reachable from this machine or a unix socket path. Can be repeated to forward multiple targets")
 	k8sCmd.Flags().StringVarP(&controlServerPort, "control-server-port", "c", "", "The port on which control server listens")
 	k8sCmd.Flags().StringVarP(&kubeContext, "context", "", "", "The name of the kubeconfig context to use")
-	k8sCmd.Flags().StringVarP(&servicePort, "service-port", "s", "", "The port on which the service is exposed. If not specified, local-port is used")
-	k8sCmd.Flags().StringVarP(&name, "name", "n", "", "The name of this specific run. Reuse a name to replace older instance. If no name is specified a random string is used instead")
+	k8sCmd.Flags().BoolVarP(&enableTLS, "tls", "", false, "Use mutual TLS between the local and remote components, with certificates generated for this run")
+	k8sCmd.Flags().DurationVarP(&gracePeriod, "grace-period", "", time.Second*10, "How long new connections in the remote wait for the local component to reconnect. 0 disables waiting")
+	k8sCmd.Flags().Int64VarP(&maxPending, "max-pending", "", 128, "The maximum number of connections the remote holds while waiting for the local component to reconnect")
+	k8sCmd.Flags().StringVarP(&onUnavailable, "on-unavailable", "", string(remote.FailureActionReset), "How the remote terminates connections that cannot be proxied. One of close, reset or http")
+	k8sCmd.Flags().StringArrayVarP(&upstreamSpecs, "upstream", "", nil, "Address in the cluster to which the remote sends connections when the local component is unavailable, as [SERVICE_PORT=]HOST:PORT")
+	k8sCmd.Flags().StringVarP(&fallbackService, "fallback-service", "", "", "An existing service, as [NAMESPACE/]NAME, to which the remote sends connections when the local component is unavailable. Fills upstream for all the forwarded tcp ports. Without a NAMESPACE, the namespace of the intercepted service, or else of the kubeconfig context, is used")
+	k8sCmd.Flags().StringVarP(&routeHeader, "route-header", "", "", "Route every http request on its own, as HEADER=VALUE. Only the requests with the header are sent to the local targets, the rest go to the upstream")
+	k8sCmd.Flags().StringVarP(&mirrorMode, "mirror", "", string(remote.MirrorOff), "Send connections to the upstream and only copy their traffic to the local targets, discarding the local answers. One of off, requests or all. With all, the upstream responses are sent to the local targets as separate connections, so use it only with targets which record what they receive, never with servers")
+	k8sCmd.Flags().StringVarP(&proxyProtocol, "proxy-protocol", "", "", "Send a PROXY protocol header, v1 or v2, with the address of the in-cluster client to the local tcp targets")
+	k8sCmd.Flags().BoolVarP(&acceptProxyProtocol, "accept-proxy-protocol", "", false, "Expect a PROXY protocol header on every tcp connection to the remote service, and use the client address from it")
+	k8sCmd.Flags().StringVarP(&metricsPort, "metrics-port", "", "", "The port on which the remote component serves prometheus metrics. The pod gets the prometheus scrape annotations when set")
+	k8sCmd.Flags().StringVarP(&healthPort, "health-port", "", "8099", "The port on which the remote component serves the endpoints used by its liveness and readiness probes")
+	k8sCmd.Flags().BoolVarP(&readyRequiresClient, "ready-requires-client", "", false, "Keep the remote pod unready, and out of the service endpoints, while the local component is not connected")
+	k8sCmd.Flags().DurationVarP(&readyTimeout, "ready-timeout", "", time.Minute*5, "How long to wait for the remote pod to become ready before giving up")
+	k8sCmd.Flags().StringVarP(&remoteLogs, "remote-logs", "", string(k8s.LogsErrors), "Which lines of the remote component logs are shown locally, across pod restarts. One of off, errors or all")
+	k8sCmd.Flags().DurationVarP(&drainTimeout, "drain-timeout", "", time.Second*10, "How long connections in flight are given to finish on exit, before the remote resources are deleted")
+	k8sCmd.Flags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", time.Minute, "How long the cleanup on exit may take in total, including waiting for the namespace to be deleted. Exit again to skip it")
+	k8sCmd.Flags().DurationVarP(&ttl, "ttl", "", time.Hour, "How long the session is kept after this command stops running, for example when the machine crashes, before gc deletes it. 0 keeps it until deleted")
+	k8sCmd.Flags().DurationVarP(&idleTimeout, "idle-timeout", "", 0, "Make the remote component self-destruct once no local component is connected for this long. Requires self-destruct. 0 disables it")
+	k8sCmd.Flags().BoolVarP(&selfDestruct, "self-destruct", "", false, "Let the remote component delete its namespace once idle-timeout is over. It gets a service account allowed to delete only its namespace. With intercept, it restores the intercepted service and deletes only the resources of this run instead")
+	k8sCmd.Flags().BoolVarP(&exposeControl, "expose-control-server", "", false, "Also expose the control server port through the in-cluster service. By default it is only reachable through port forwarding")
+	k8sCmd.Flags().StringVarP(&servicePort, "service-port", "s", "", "The port on which the service is exposed when a single local-port is forwarded. If not specified, local-port is used")
+	k8sCmd.Flags().StringVarP(&intercept, "intercept", "", "", "An existing service, as svc/NAME, whose traffic is sent to the local targets instead of its pods. The remote component is deployed in the namespace of the service and the original selector of the service is restored on exit. If this command does not exit cleanly, for example when the machine crashes, the selector is restored by the remote component with idle-timeout and self-destruct, and otherwise only by gc or down once the ttl is over")
+	k8sCmd.Flags().StringVarP(&targetNamespace, "namespace", "", "", "The namespace of the intercepted service. If not specified, the namespace of the kubeconfig context is used")
+	k8sCmd.Flags().StringVarP(&name, "name", "n", "", "The name of this specific run. Reuse a name to replace your older instance. Instances of other users or machines are only replaced with --takeover. If no name is specified a random string is used instead")
+	k8sCmd.Flags().BoolVarP(&takeover, "takeover", "", false, "Replace a live instance with the same name even if it was started by another user or on another machine")
+	addKubeconfigFlag(k8sCmd)
+	k8sCmd.MarkFlagRequired("local-port")
+}
+
+// newK8sConfig returns the config of the session from the flags of the k8s command.
+func newK8sConfig(namespace string, mappings []mapping.Mapping, token string, tlsBundle *certs.Bundle, mirror remote.MirrorMode, interceptService string) k8s.Config {
+	return k8s.Config{
+		AppName:             AppName,
+		Namespace:           namespace,
+		Version:             version.Version,
+		ControlServerPort:   controlServerPort,
+		Mappings:            mappings,
+		Kubeconfig:          kubeconfig,
+		KubeContext:         kubeContext,
+		Token:               token,
+		ExposeControl:       exposeControl,
+		TLS:                 tlsBundle,
+		GracePeriod:         gracePeriod.String(),
+		MaxPending:          maxPending,
+		OnUnavailable:       onUnavailable,
+		Upstreams:           upstreamSpecs,
+		FallbackService:     fallbackService,
+		RouteHeader:         routeHeader,
+		Mirror:              string(mirror),
+		AcceptProxyProtocol: acceptProxyProtocol,
+		MetricsPort:         metricsPort,
+		HealthPort:          healthPort,
+		ReadyRequiresClient: readyRequiresClient,
+		ReadyTimeout:        readyTimeout,
+		RemoteLogs:          remoteLogs,
+		Intercept:           interceptService,
+		Session:             name,
+		Owner:               currentUser(),
+		Host:                currentHost(),
+		TTL:                 ttl,
+		IdleTimeout:         idleTimeout,
+		SelfDestruct:        selfDestruct,
+		Takeover:            takeover,
+	}
+}
+
+// addKubeconfigFlag adds the kubeconfig flag. The context has to be given when there is no default kubeconfig.
+func addKubeconfigFlag(cmd *cobra.Command) {
 	if home := homedir.HomeDir(); home == "" {
-		k8sCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", "", "Path to the kubeconfig file to use for requests")
-		k8sCmd.MarkFlagRequired("context")
+		cmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", "", "Path to the kubeconfig file to use for requests")
+		cmd.MarkFlagRequired("context")
 	} else {
-		k8sCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", filepath.Join(home, ".kube", "config"), "Path to the kubeconfig file to use for requests")
+		cmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", filepath.Join(home, ".kube", "config"), "Path to the kubeconfig file to use for requests")
 	}
-	k8sCmd.MarkFlagRequired("local-port")
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func currentHost() string {
+	host, _ := os.Hostname()
+	return host
 }
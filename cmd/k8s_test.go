@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/v4run/reversepf/internal/k8s"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/remote"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+func TestK8sDefaultsRenderDeployment(t *testing.T) {
+	if err := k8sCmd.ParseFlags([]string{"-l", "8888"}); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := mapping.ParseAll(localPorts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newK8sConfig("reversepf-test", mappings, "token", nil, remote.MirrorOff, "")
+	config.Version, config.ControlServerPort = "v1", "9000"
+	manifest, err := k8s.RenderDeployment(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj unstructured.Unstructured
+	if _, _, err := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode([]byte(manifest), nil, &obj); err != nil {
+		t.Fatalf("decoding deployment: %v\n%s", err, manifest)
+	}
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 1 {
+		t.Fatalf("deployment has %d containers, want 1", len(containers))
+	}
+	container := containers[0].(map[string]interface{})
+	args, _, _ := unstructured.NestedStringSlice(container, "args")
+	if i := slices.Index(args, "--health-port"); i < 0 || i+1 == len(args) || args[i+1] != "8099" {
+		t.Errorf("args = %q, want --health-port 8099", args)
+	}
+	ports, _, _ := unstructured.NestedSlice(container, "ports")
+	var healthPort int64
+	for _, port := range ports {
+		if p := port.(map[string]interface{}); p["name"] == "health" {
+			healthPort, _, _ = unstructured.NestedInt64(p, "containerPort")
+		}
+	}
+	if healthPort != 8099 {
+		t.Errorf("health containerPort = %d, want 8099", healthPort)
+	}
+}
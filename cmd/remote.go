@@ -1,52 +1,214 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
+	"github.com/v4run/reversepf/internal/certs"
+	"github.com/v4run/reversepf/internal/k8s"
+	"github.com/v4run/reversepf/internal/mapping"
 	"github.com/v4run/reversepf/internal/remote"
 )
 
 var (
-	servicePort       string
-	controlServerPort string
-	portalPort        string
+	servicePorts        []string
+	controlServerPort   string
+	connectTimeout      time.Duration
+	exposeControl       bool
+	tlsCertFile         string
+	tlsKeyFile          string
+	tlsCAFile           string
+	udpIdleTimeout      time.Duration
+	gracePeriod         time.Duration
+	maxPending          int64
+	onUnavailable       string
+	upstreamSpecs       []string
+	routeHeader         string
+	mirrorMode          string
+	acceptProxyProtocol bool
+	metricsPort         string
+	readyRequiresClient bool
+	idleTimeout         time.Duration
+	selfDestruct        bool
+	// the flags of the remote command which are also flags of the k8s command, with a different default or
+	// meaning, have their own variables, as a flag writes its default into its variable when it is added
+	remoteHealthPort string
+	remoteIntercept  string
+	remoteSession    string
 )
 
+// namespaceEnv is the environment variable from which the remote component reads the namespace of its pod.
+const namespaceEnv = "POD_NAMESPACE"
+
+// tokenEnv is the environment variable from which the remote component reads the token used to
+// authenticate the local component. It is not a flag so that the token does not show up in the pod spec.
+const tokenEnv = "REVERSEPF_TOKEN"
+
 // remoteCmd represents the remote command
 var remoteCmd = &cobra.Command{
 	Use:   "remote",
 	Short: "The remote component that is run on the remote server",
-	Long: `This component is run on the remote server. It has three sub components:
+	Long: `This component is run on the remote server. It has two sub components:
 	- Service
-	- Portal
 	- Control Server
 
 Service
-Other services in the remote server should connect to this component. It listens on "service-port".
-
-Portal
-The "portal" listens for new connections and proxies all the traffic to the service. It listens on "portal-port".
-So, the "portal-port" should be accessible from the local machine.
+Other services in the remote server should connect to this component. It listens on every "service-port".
+Every connection is proxied to the local machine as a new stream over the control server connection.
 
 Control Server
-"control server" is used to transfer control messages. It listen on "control-server-port". So, "control-server-port" 
-also should be accessible from local machine.
+"control server" accepts the connection from the local machine. It listen on "control-server-port". All the
+control messages and proxied streams are multiplexed over this single connection. So, "control-server-port"
+should be accessible from local machine.
 	`,
 	Run: func(_ *cobra.Command, _ []string) {
-		portal := remote.NewPortal(portalPort)
-		controlServer := remote.NewControlServer(controlServerPort)
-		service := remote.NewService(servicePort, portal.Connection, controlServer.SendMessage)
-		go portal.Start()
+		// The control server is reached through kube port-forward, which connects on the loopback interface
+		controlServerHost := "127.0.0.1"
+		if exposeControl {
+			controlServerHost = ""
+		}
+		tlsConfig, err := loadServerTLSConfig()
+		if err != nil {
+			log.Fatal("Error loading tls config", "err", err)
+		}
+		controlServer := remote.NewControlServer(controlServerHost, controlServerPort, connectTimeout, os.Getenv(tokenEnv), tlsConfig)
+		failureAction, err := remote.ParseFailureAction(onUnavailable)
+		if err != nil {
+			log.Fatal("Invalid on-unavailable", "err", err)
+		}
+		upstreams, err := remote.ParseUpstreams(upstreamSpecs)
+		if err != nil {
+			log.Fatal("Invalid upstream", "err", err)
+		}
+		var route *remote.Route
+		if routeHeader != "" {
+			if route, err = remote.ParseRoute(routeHeader); err != nil {
+				log.Fatal("Invalid route-header", "err", err)
+			}
+		}
+		mirror, err := remote.ParseMirrorMode(mirrorMode)
+		if err != nil {
+			log.Fatal("Invalid mirror", "err", err)
+		}
+		if route != nil && mirror != remote.MirrorOff {
+			log.Fatal("route-header and mirror cannot be used together")
+		}
+		availability := remote.NewAvailability(gracePeriod, maxPending, failureAction, controlServer.WaitForClient)
+		var services []interface {
+			Start()
+			Ready() <-chan struct{}
+		}
+		for _, spec := range servicePorts {
+			port, protocol, err := mapping.ParseServicePort(spec)
+			if err != nil {
+				log.Fatal("Invalid service port", "err", err)
+			}
+			if protocol == mapping.ProtocolUDP {
+				service := remote.NewUDPService(port, udpIdleTimeout, controlServer.OpenStream, availability)
+				services = append(services, &service)
+			} else {
+				upstream, serviceRoute, serviceMirror := remote.UpstreamFor(upstreams, port), route, mirror
+				if upstream == "" && (route != nil || mirror != remote.MirrorOff) {
+					log.Warn("No upstream for service port. Its connections are proxied to the local component as usual", "port", port)
+					serviceRoute, serviceMirror = nil, remote.MirrorOff
+				}
+				service := remote.NewService(port, controlServer.OpenStream, availability, upstream, serviceRoute, serviceMirror)
+				service.AcceptProxyProtocol = acceptProxyProtocol
+				services = append(services, &service)
+			}
+		}
+		if metricsPort != "" {
+			metricsServer := remote.NewMetricsServer(metricsPort)
+			go metricsServer.Start()
+		}
+		if remoteHealthPort != "" {
+			listeners := []<-chan struct{}{controlServer.Ready()}
+			for _, service := range services {
+				listeners = append(listeners, service.Ready())
+			}
+			healthServer := remote.NewHealthServer(remoteHealthPort, listeners, controlServer.ClientConnected, readyRequiresClient)
+			go healthServer.Start()
+		}
+		if idleTimeout > 0 {
+			go func() {
+				controlServer.WaitForIdle(idleTimeout)
+				log.Warn("No local component connected within the idle timeout. Exiting", "idleTimeout", idleTimeout)
+				if selfDestruct {
+					// deleting the resources of the pod terminates it, which must not stop the cleanup halfway
+					signal.Ignore(syscall.SIGTERM)
+					config := k8s.Config{AppName: AppName, Namespace: os.Getenv(namespaceEnv), Intercept: remoteIntercept, Session: remoteSession}
+					if remoteIntercept != "" {
+						log.Info("Restoring intercepted service and deleting session", "service", remoteIntercept, "session", remoteSession)
+					} else {
+						log.Info("Deleting namespace", "namespace", config.Namespace)
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+					defer cancel()
+					if err := k8s.SelfDestruct(ctx, config); err != nil {
+						log.Error("Unable to self-destruct", "err", err)
+					}
+				}
+				os.Exit(0)
+			}()
+		}
 		go controlServer.Start()
-		service.Start()
+		for _, service := range services[1:] {
+			go service.Start()
+		}
+		services[0].Start()
 	},
 }
 
+func loadServerTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" && tlsCAFile == "" {
+		return nil, nil
+	}
+	cert, err := os.ReadFile(tlsCertFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(tlsCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return certs.ServerConfig(cert, key, ca)
+}
+
 func init() {
 	rootCmd.AddCommand(remoteCmd)
-	remoteCmd.Flags().StringVarP(&servicePort, "service-port", "s", "", "The port on which the service is exposed")
+	remoteCmd.Flags().StringSliceVarP(&servicePorts, "service-port", "s", nil, "The port on which the service is exposed, as PORT[/PROTOCOL]. Can be repeated to expose multiple ports")
+	remoteCmd.Flags().DurationVarP(&udpIdleTimeout, "udp-idle-timeout", "", time.Minute, "How long a udp flow is kept open without any datagrams")
 	remoteCmd.Flags().StringVarP(&controlServerPort, "control-server-port", "c", "", "The port on which control server listens")
-	remoteCmd.Flags().StringVarP(&portalPort, "portal-port", "p", "", "The port to which the local client component connects")
+	remoteCmd.Flags().DurationVarP(&connectTimeout, "connect-timeout", "", time.Second*10, "How long to wait for the local component to accept a new connection")
+	remoteCmd.Flags().BoolVarP(&exposeControl, "expose-control-server", "", false, "Listen for control server connections on all interfaces instead of only loopback")
+	remoteCmd.Flags().StringVarP(&tlsCertFile, "tls-cert", "", "", "Path to the certificate used for mutual TLS with the local component")
+	remoteCmd.Flags().StringVarP(&tlsKeyFile, "tls-key", "", "", "Path to the private key of the tls certificate")
+	remoteCmd.Flags().StringVarP(&tlsCAFile, "tls-ca", "", "", "Path to the CA certificate used to verify the local component")
+	remoteCmd.Flags().DurationVarP(&gracePeriod, "grace-period", "", time.Second*10, "How long new connections wait for the local component to reconnect. 0 disables waiting")
+	remoteCmd.Flags().Int64VarP(&maxPending, "max-pending", "", 128, "The maximum number of connections waiting for the local component to reconnect")
+	remoteCmd.Flags().StringVarP(&onUnavailable, "on-unavailable", "", string(remote.FailureActionReset), "How to terminate connections that cannot be proxied. One of close, reset or http")
+	remoteCmd.Flags().StringArrayVarP(&upstreamSpecs, "upstream", "", nil, "Fallback address for connections that cannot be proxied to the local component, as [SERVICE_PORT=]HOST:PORT. Can be repeated for each service port")
+	remoteCmd.Flags().StringVarP(&routeHeader, "route-header", "", "", "Route every http request on its own, as HEADER=VALUE. Only the requests with the header are sent to the local component, the rest go to the upstream of the service port")
+	remoteCmd.Flags().StringVarP(&mirrorMode, "mirror", "", string(remote.MirrorOff), "Send connections to the upstream of the service port and only copy their traffic to the local component. One of off, requests or all. With all, the upstream responses are sent to the local targets as separate connections, so use it only with targets which record what they receive")
+	remoteCmd.Flags().BoolVarP(&acceptProxyProtocol, "accept-proxy-protocol", "", false, "Expect a PROXY protocol header, v1 or v2, on every tcp connection and report the client address from it to the local component")
+	remoteCmd.Flags().StringVarP(&metricsPort, "metrics-port", "", "", "The port on which prometheus metrics are served at /metrics. Metrics are not served if not specified")
+	remoteCmd.Flags().StringVarP(&remoteHealthPort, "health-port", "", "", "The port on which /healthz and /readyz are served. They are not served if not specified")
+	remoteCmd.Flags().BoolVarP(&readyRequiresClient, "ready-requires-client", "", false, "Report ready at /readyz only while a local component is connected")
+	remoteCmd.Flags().DurationVarP(&idleTimeout, "idle-timeout", "", 0, "Exit once no local component is connected for this long. 0 disables it")
+	remoteCmd.Flags().BoolVarP(&selfDestruct, "self-destruct", "", false, "Delete the namespace of the pod, read from "+namespaceEnv+", when exiting for the idle timeout")
+	remoteCmd.Flags().StringVarP(&remoteIntercept, "intercept", "", "", "With self-destruct, the name of the service intercepted by the session. Its selector is restored and only the resources of the session are deleted instead of the namespace")
+	remoteCmd.Flags().StringVarP(&remoteSession, "session", "", "", "With intercept, the name of the session whose resources are deleted")
+	remoteCmd.MarkFlagsRequiredTogether("tls-cert", "tls-key", "tls-ca")
 	remoteCmd.MarkFlagRequired("service-port")
 	remoteCmd.MarkFlagRequired("control-server-port")
-	remoteCmd.MarkFlagRequired("local-client-port")
 }
@@ -8,7 +8,7 @@ import (
 )
 
 var (
-	localPort string
+	localPorts []string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -20,7 +20,7 @@ var rootCmd = &cobra.Command{
 It has two parts. A local and a remote part. Both the parts works together to make the port accessible.
 
 Local
-This part proxies traffic between the local service port and the "portal-port".
+This part proxies traffic between the local service port and the "control-server-port".
 
 Remote
 This part runs in the remote server and proxies traffic there.`,
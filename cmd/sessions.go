@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"github.com/v4run/reversepf/internal/k8s"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// statusTimeout is how long the status of a session is waited for.
+const statusTimeout = 5 * time.Second
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the sessions in the k8s cluster",
+	Run: func(_ *cobra.Command, _ []string) {
+		ctx := context.Background()
+		deployer := newSessionDeployer()
+		sessions, err := deployer.ListSessions(ctx)
+		if err != nil {
+			log.Error("Error listing sessions", "err", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tNAMESPACE\tOWNER\tAGE\tSERVICE\tCLIENT")
+		statuses, timedOut := sessionStatuses(ctx, deployer, sessions)
+		for i, session := range sessions {
+			status := statuses[i]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				session.Name,
+				session.Namespace,
+				sessionOwner(session),
+				sessionAge(session.CreatedAt),
+				orUnknown(strings.Join(status.Addrs, ","), timedOut[i]),
+				clientState(status),
+			)
+		}
+		w.Flush()
+	},
+}
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of a session in the k8s cluster",
+	Run: func(_ *cobra.Command, _ []string) {
+		ctx := context.Background()
+		deployer := newSessionDeployer()
+		session, err := findSession(ctx, deployer)
+		if err != nil {
+			log.Error("Error finding session", "name", name, "err", err)
+			os.Exit(1)
+		}
+		status, timedOut := sessionStatus(ctx, deployer, session)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Name:\t%s\n", session.Name)
+		fmt.Fprintf(w, "Namespace:\t%s\n", session.Namespace)
+		if session.Intercept != "" {
+			fmt.Fprintf(w, "Intercepts:\t%s\n", session.Intercept)
+		}
+		fmt.Fprintf(w, "Owner:\t%s\n", sessionOwner(session))
+		fmt.Fprintf(w, "Age:\t%s\n", sessionAge(session.CreatedAt))
+		fmt.Fprintf(w, "Last seen:\t%s ago\n", sessionAge(session.LastSeen()))
+		if session.TTL > 0 {
+			fmt.Fprintf(w, "TTL:\t%s\n", session.TTL)
+		}
+		fmt.Fprintf(w, "Service:\t%s\n", orUnknown(strings.Join(status.Addrs, ", "), timedOut))
+		fmt.Fprintf(w, "Pod:\t%s\n", orUnknown(status.Pod, timedOut))
+		if status.Remote != nil {
+			fmt.Fprintf(w, "Remote version:\t%s\n", status.Remote.Version)
+			ready := "yes"
+			if !status.Remote.Ready {
+				ready = "no, " + status.Remote.Reason
+			}
+			fmt.Fprintf(w, "Ready:\t%s\n", ready)
+		}
+		fmt.Fprintf(w, "Client:\t%s\n", clientState(status))
+		w.Flush()
+	},
+}
+
+// downCmd represents the down command
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Delete a session in the k8s cluster",
+	Long: `Deletes the resources of a session, restoring the service it intercepts. A local component still running
+for the session loses its connection.`,
+	Run: func(_ *cobra.Command, _ []string) {
+		ctx := context.Background()
+		deployer := newSessionDeployer()
+		session, err := findSession(ctx, deployer)
+		if err != nil {
+			log.Error("Error finding session", "name", name, "err", err)
+			os.Exit(1)
+		}
+		deleteCtx, cancel := context.WithTimeout(ctx, waitTimeout)
+		defer cancel()
+		deployer.DeleteSession(deleteCtx, session)
+	},
+}
+
+func newSessionDeployer() k8s.Deployer {
+	return k8s.NewDeployer(k8s.Config{
+		AppName:     AppName,
+		Kubeconfig:  kubeconfig,
+		KubeContext: kubeContext,
+	})
+}
+
+// findSession returns the session with the name. The namespace is needed only when sessions in different
+// namespaces intercepting services share the name.
+func findSession(ctx context.Context, deployer k8s.Deployer) (k8s.Session, error) {
+	sessions, err := deployer.ListSessions(ctx)
+	if err != nil {
+		return k8s.Session{}, err
+	}
+	var found []k8s.Session
+	for _, session := range sessions {
+		if session.Name == name && (targetNamespace == "" || session.Namespace == targetNamespace) {
+			found = append(found, session)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return k8s.Session{}, fmt.Errorf("no session named %s", name)
+	case 1:
+		return found[0], nil
+	default:
+		return k8s.Session{}, fmt.Errorf("%d sessions named %s. Select one with --namespace", len(found), name)
+	}
+}
+
+// sessionStatus gets the status of the session, giving up after statusTimeout so that an unreachable pod
+// does not hang the command. It also reports whether the status is incomplete because of the timeout.
+func sessionStatus(ctx context.Context, deployer k8s.Deployer, session k8s.Session) (k8s.SessionStatus, bool) {
+	statuses, timedOut := sessionStatuses(ctx, deployer, []k8s.Session{session})
+	return statuses[0], timedOut[0]
+}
+
+// sessionStatuses gets the statuses of the sessions concurrently, all within one statusTimeout, and reports for
+// each whether its status is incomplete because of the timeout.
+func sessionStatuses(ctx context.Context, deployer k8s.Deployer, sessions []k8s.Session) ([]k8s.SessionStatus, []bool) {
+	statusCtx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	statuses, timedOut := make([]k8s.SessionStatus, len(sessions)), make([]bool, len(sessions))
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		wg.Add(1)
+		go func(i int, session k8s.Session) {
+			defer wg.Done()
+			statuses[i] = deployer.Status(statusCtx, session)
+			timedOut[i] = statusCtx.Err() != nil
+		}(i, session)
+	}
+	wg.Wait()
+	return statuses, timedOut
+}
+
+// orUnknown returns "unknown" for a value missing because the status timed out.
+func orUnknown(value string, timedOut bool) string {
+	if value == "" && timedOut {
+		return "unknown"
+	}
+	return value
+}
+
+func sessionOwner(session k8s.Session) string {
+	if session.Host == "" {
+		return session.Owner
+	}
+	return session.Owner + "@" + session.Host
+}
+
+func sessionAge(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return duration.HumanDuration(time.Since(t))
+}
+
+func clientState(status k8s.SessionStatus) string {
+	switch {
+	case status.Remote == nil:
+		return "unknown"
+	case status.Remote.ClientConnected:
+		return "attached"
+	default:
+		return "detached"
+	}
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{listCmd, statusCmd, downCmd} {
+		rootCmd.AddCommand(cmd)
+		cmd.Flags().StringVarP(&kubeContext, "context", "", "", "The name of the kubeconfig context to use")
+		addKubeconfigFlag(cmd)
+	}
+	for _, cmd := range []*cobra.Command{statusCmd, downCmd} {
+		cmd.Flags().StringVarP(&name, "name", "n", "", "The name of the session")
+		cmd.Flags().StringVarP(&targetNamespace, "namespace", "", "", "The namespace of the session. Only needed when sessions intercepting services in different namespaces share the name")
+		cmd.MarkFlagRequired("name")
+	}
+	downCmd.Flags().DurationVarP(&waitTimeout, "wait-timeout", "", time.Minute, "How long to wait for the namespace of the session to be deleted")
+}
@@ -0,0 +1,133 @@
+package certs
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const serverName = "reversepf"
+
+func generate(t *testing.T) Bundle {
+	t.Helper()
+	bundle, err := Generate(serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+// serve accepts a single connection on a listener using the server config of the bundle, answers "pong" to
+// the first byte it reads, and returns the error of the server side.
+func serve(t *testing.T, bundle Bundle) (string, <-chan error) {
+	t.Helper()
+	config, err := ServerConfig(bundle.ServerCert, bundle.ServerKey, bundle.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := tls.NewListener(listener, config).Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			errs <- err
+			return
+		}
+		_, err = conn.Write([]byte("pong"))
+		errs <- err
+	}()
+	return listener.Addr().String(), errs
+}
+
+// ping sends a byte over the connection and reads the answer.
+func ping(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("p")); err != nil {
+		return "", err
+	}
+	answer, err := io.ReadAll(conn)
+	return string(answer), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	bundle := generate(t)
+	addr, serverErr := serve(t, bundle)
+	config, err := ClientConfig(bundle.ClientCert, bundle.ClientKey, bundle.CA, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := ping(addr, config)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if answer != "pong" {
+		t.Errorf("answer = %q, want %q", answer, "pong")
+	}
+}
+
+func TestClientCertificateFromOtherCARejected(t *testing.T) {
+	bundle, other := generate(t), generate(t)
+	addr, serverErr := serve(t, bundle)
+	// the client trusts the server, but presents a certificate signed by another CA
+	config, err := ClientConfig(other.ClientCert, other.ClientKey, bundle.CA, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ping(addr, config); err == nil {
+		t.Error("client: connection succeeded")
+	}
+	if err := <-serverErr; err == nil {
+		t.Error("server: connection with a certificate from another CA accepted")
+	}
+}
+
+func TestClientWithoutCertificateRejected(t *testing.T) {
+	bundle := generate(t)
+	addr, serverErr := serve(t, bundle)
+	config, err := ClientConfig(bundle.ClientCert, bundle.ClientKey, bundle.CA, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = nil
+	if _, err := ping(addr, config); err == nil {
+		t.Error("client: connection succeeded")
+	}
+	if err := <-serverErr; err == nil {
+		t.Error("server: connection without a client certificate accepted")
+	}
+}
+
+func TestServerFromOtherCARejected(t *testing.T) {
+	bundle, other := generate(t), generate(t)
+	addr, serverErr := serve(t, bundle)
+	config, err := ClientConfig(bundle.ClientCert, bundle.ClientKey, other.CA, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ping(addr, config); err == nil {
+		t.Error("client: server certificate from another CA accepted")
+	}
+	if err := <-serverErr; err == nil {
+		t.Error("server: connection succeeded")
+	}
+}
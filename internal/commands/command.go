@@ -1,33 +1,62 @@
 package commands
 
 import (
+	"bufio"
 	"encoding/json"
-	"io"
 )
 
 type CommandType int8
 
 const (
 	TypeInit CommandType = iota
+	TypeInitAck
+	TypeHello
+	TypeError
+	TypeDialFailed
 )
 
 type Command struct {
 	Type CommandType `json:"type"`
+	// ID identifies the connection a command belongs to
+	ID string `json:"id,omitempty"`
+	// ServicePort is the port of the remote service on which the connection was received
+	ServicePort string `json:"servicePort,omitempty"`
+	// Network is the network of the service port, tcp or udp
+	Network string `json:"network,omitempty"`
+	// Source is the address of the client which connected to the remote service
+	Source string `json:"source,omitempty"`
+	// Destination is the address of the remote service the client connected to
+	Destination string   `json:"destination,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	Protocol    int      `json:"protocol,omitempty"`
+	Features    []string `json:"features,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	Token       string   `json:"token,omitempty"`
 }
 
+// Bytes returns the newline terminated json representation of the command.
 func (c Command) Bytes() []byte {
 	data, _ := json.Marshal(c)
-	return data
+	return append(data, '\n')
 }
 
 func (c Command) String() string {
-	return string(c.Bytes())
+	data, _ := json.Marshal(c)
+	return string(data)
 }
 
-func ReadCommand(reader io.Reader) (Command, error) {
+func ParseCommand(data []byte) (Command, error) {
 	var cmd Command
-	if err := json.NewDecoder(reader).Decode(&cmd); err != nil {
+	if err := json.Unmarshal(data, &cmd); err != nil {
 		return Command{}, err
 	}
 	return cmd, nil
 }
+
+func ReadCommand(reader *bufio.Reader) (Command, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return Command{}, err
+	}
+	return ParseCommand(line)
+}
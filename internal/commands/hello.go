@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/v4run/reversepf/version"
+)
+
+// ProtocolVersion is bumped whenever the local and remote components stop being compatible.
+const ProtocolVersion = 1
+
+// Optional features. A feature is used only when both the components support it.
+const (
+	// FeatureInitAck makes the local component acknowledge every new connection.
+	FeatureInitAck = "init-ack"
+	// FeatureUDP allows udp flows to be proxied to the local component.
+	FeatureUDP = "udp"
+)
+
+// SupportedFeatures lists all the optional features this binary supports.
+var SupportedFeatures = []string{
+	FeatureInitAck,
+	FeatureUDP,
+}
+
+// NewHelloCommand is the first command exchanged on a new control connection.
+// The local component uses the token to authenticate itself.
+func NewHelloCommand(features []string, token string) Command {
+	return Command{
+		Type:     TypeHello,
+		Version:  version.Version,
+		Protocol: ProtocolVersion,
+		Features: features,
+		Token:    token,
+	}
+}
+
+// ErrAuthenticationFailed is sent by the control server as the reason of an error command when the token does
+// not match.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+func NewErrorCommand(reason string) Command {
+	return Command{
+		Type:   TypeError,
+		Reason: reason,
+	}
+}
+
+// CommonFeatures returns the features present in both the lists.
+func CommonFeatures(a, b []string) []string {
+	var common []string
+	for _, f := range a {
+		if slices.Contains(b, f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
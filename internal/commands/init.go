@@ -1,7 +1,30 @@
 package commands
 
-func NewInitCommand() Command {
+// NewInitCommand is sent along with every new stream. The source and destination are the addresses of
+// the connection as seen by the remote component.
+func NewInitCommand(servicePort, network, source, destination string) Command {
 	return Command{
-		Type: TypeInit,
+		Type:        TypeInit,
+		ServicePort: servicePort,
+		Network:     network,
+		Source:      source,
+		Destination: destination,
+	}
+}
+
+// NewDialFailedCommand is sent back by the local component when it cannot connect to the local target.
+func NewDialFailedCommand(id, reason string) Command {
+	return Command{
+		Type:   TypeDialFailed,
+		ID:     id,
+		Reason: reason,
+	}
+}
+
+// NewInitAckCommand is sent back by the local component once the connection with the given id is ready.
+func NewInitAckCommand(id string) Command {
+	return Command{
+		Type: TypeInitAck,
+		ID:   id,
 	}
 }
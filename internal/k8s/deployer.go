@@ -5,14 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/remote"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -32,40 +39,151 @@ import (
 )
 
 type Deployer struct {
-	client    *dynamic.DynamicClient
+	client    dynamic.Interface
 	decoder   runtime.Serializer
 	mapper    *restmapper.DeferredDiscoveryRESTMapper
 	config    *rest.Config
 	k8sConfig Config
+	// contextNamespace is the namespace of the kubeconfig context
+	contextNamespace string
+	// addrs are the addresses through which the forwarded ports are reachable in the cluster
+	addrs []string
+	// interceptHosts are the hosts by which the intercepted service is reached
+	interceptHosts []string
+	// deployedAt is when the remote components were last deployed. Older events are not reported
+	deployedAt time.Time
 }
 
-func (d Deployer) Cleanup(ctx context.Context) {
+var namespaceRes = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}
+
+// Cleanup deletes the remote resources deployed by this run. Nothing is deleted if this run did not deploy
+// anything, or if another run replaced the session since.
+func (d *Deployer) Cleanup(ctx context.Context) {
+	if d.deployedAt.IsZero() {
+		return
+	}
+	if d.replaced(ctx) {
+		log.Warn("Session was replaced by another run. Leaving its remote resources", "name", d.k8sConfig.Session)
+		return
+	}
+	d.deleteResources(ctx)
+}
+
+// deleteResources deletes the remote resources of the session. The namespace is waited for until it is gone or
+// the context is done.
+func (d *Deployer) deleteResources(ctx context.Context) {
 	log.Info("Cleaning up remote resources")
-	namespaceRes := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}
-	if err := d.client.Resource(namespaceRes).Delete(ctx, d.k8sConfig.Namespace, metav1.DeleteOptions{}); err != nil {
-		log.Error("Unable to do cleanup. Please do the cleanup manually", "err", err)
+	if d.k8sConfig.Intercept != "" {
+		d.cleanupIntercept(ctx)
+		return
+	}
+	namespaces := d.client.Resource(namespaceRes)
+	if err := namespaces.Delete(ctx, d.k8sConfig.Namespace, metav1.DeleteOptions{}); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error("Unable to do cleanup. Please do the cleanup manually", "err", err)
+		}
+		return
+	}
+	log.Info("Waiting for namespace to be deleted", "name", d.k8sConfig.Namespace)
+	for {
+		_, err := namespaces.Get(ctx, d.k8sConfig.Namespace, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			log.Info("Namespace deleted", "name", d.k8sConfig.Namespace)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn("Namespace is still being deleted. Check it with kubectl", "name", d.k8sConfig.Namespace)
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-func (d Deployer) Deploy(ctx context.Context) error {
+// Mappings returns the mappings served by the remote component. They differ from the configured mappings when
+// a service is intercepted.
+func (d *Deployer) Mappings() []mapping.Mapping {
+	return d.k8sConfig.Mappings
+}
+
+func (d *Deployer) Deploy(ctx context.Context) error {
+	if err := d.checkOwnership(ctx); err != nil {
+		log.Error("Session name is in use", "err", err)
+		return err
+	}
+	if d.k8sConfig.Intercept != "" {
+		if err := d.prepareIntercept(ctx); err != nil {
+			log.Error("Error preparing to intercept service", "service", d.k8sConfig.Intercept, "err", err)
+			return err
+		}
+	} else {
+		for _, m := range d.k8sConfig.Mappings {
+			d.addrs = append(d.addrs, fmt.Sprintf("%s.%s:%s", d.k8sConfig.AppName, d.k8sConfig.Namespace, m.ServicePortSpec()))
+		}
+	}
+	if err := d.checkPorts(); err != nil {
+		log.Error("Error deploying remote components", "err", err)
+		return err
+	}
 	if err := d.DeployRemoteComponents(ctx); err != nil {
 		return err
 	}
-	if readChanChan, err := d.ForwardPorts(ctx, d.k8sConfig.ControlServerPort, d.k8sConfig.PortalPort); err != nil {
+	// started before waiting, so that the reasons of a crashing remote component are shown
+	d.spawn(func() { d.streamLogs(ctx) })
+	d.spawn(func() { d.renewSession(ctx) })
+	podName, err := d.waitForPod(ctx)
+	if err != nil {
+		log.Error("Remote pod did not become ready", "err", err)
+		return err
+	}
+	if d.k8sConfig.Intercept != "" {
+		// the selector is changed only once the remote component is ready
+		if err := d.interceptService(ctx); err != nil {
+			log.Error("Error intercepting service", "service", d.k8sConfig.Intercept, "err", err)
+			return err
+		}
+	}
+	if readChanChan, err := d.ForwardPorts(ctx, podName, d.k8sConfig.ControlServerPort); err != nil {
 		log.Error("Error forwarding ports", "err", err)
 		return err
 	} else {
-		go func() {
+		d.spawn(func() {
 			for r := range readChanChan {
 				<-r
-				printConnectionDetails(fmt.Sprintf("%s.%s:%s", d.k8sConfig.AppName, d.k8sConfig.Namespace, d.k8sConfig.ServicePort))
+				printConnectionDetails(strings.Join(d.addrs, "\n"))
 			}
-		}()
+		})
 	}
 	return nil
 }
 
-func (d Deployer) deploy(
+// checkPorts makes sure the ports used by the remote component itself do not clash with the service ports.
+func (d *Deployer) checkPorts() error {
+	ports := [][2]string{
+		{"control-server-port", d.k8sConfig.ControlServerPort},
+		{"health-port", d.k8sConfig.HealthPort},
+		{"metrics-port", d.k8sConfig.MetricsPort},
+	}
+	for _, m := range d.k8sConfig.Mappings {
+		if m.Protocol == mapping.ProtocolTCP {
+			ports = append(ports, [2]string{"service port", m.ServicePort})
+		}
+	}
+	used := make(map[string]string)
+	for _, p := range ports {
+		name, port := p[0], p[1]
+		if port == "" {
+			continue
+		}
+		if other, ok := used[port]; ok {
+			return fmt.Errorf("%s %s is already used as %s", name, port, other)
+		}
+		used[port] = name
+	}
+	return nil
+}
+
+func (d *Deployer) deploy(
 	ctx context.Context,
 	manifest string,
 ) error {
@@ -107,13 +225,21 @@ func (d Deployer) deploy(
 }
 
 func NewDeployer(k8sConfig Config) Deployer {
-	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		&clientcmd.ClientConfigLoadingRules{ExplicitPath: k8sConfig.Kubeconfig},
 		&clientcmd.ConfigOverrides{CurrentContext: k8sConfig.KubeContext},
-	).ClientConfig()
+	)
+	cfg, err := clientConfig.ClientConfig()
 	if err != nil {
 		log.Fatal("Error building k8s config", "err", err)
 	}
+	contextNamespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		log.Fatal("Error getting namespace from k8s config", "err", err)
+	}
+	if k8sConfig.Namespace == "" {
+		k8sConfig.Namespace = contextNamespace
+	}
 	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
 	if err != nil {
 		log.Fatal("Error creating discovery client", "err", err)
@@ -125,23 +251,98 @@ func NewDeployer(k8sConfig Config) Deployer {
 	}
 	var decoder = yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
 	deployer := Deployer{
-		client:    client,
-		decoder:   decoder,
-		mapper:    mapper,
-		config:    cfg,
-		k8sConfig: k8sConfig,
+		client:           client,
+		decoder:          decoder,
+		mapper:           mapper,
+		config:           cfg,
+		k8sConfig:        k8sConfig,
+		contextNamespace: contextNamespace,
 	}
 	return deployer
 }
 
-func (d Deployer) DeployRemoteComponents(ctx context.Context) error {
+func (d *Deployer) DeployRemoteComponents(ctx context.Context) error {
 	log.Info("Deploying remote resources")
+	d.deployedAt = time.Now()
+	d.k8sConfig.CreatedAt = d.deployedAt
 	var (
 		err  error
 		tmpl string
 	)
-	log.Info("Deploying new namespace", "name", d.k8sConfig.Namespace)
-	tmpl, err = executeTemplate(Namespace, d.k8sConfig)
+	if d.k8sConfig.FallbackService != "" {
+		upstreams, err := d.resolveFallbackService(ctx)
+		if err != nil {
+			log.Error("Error resolving fallback service", "service", d.k8sConfig.FallbackService, "err", err)
+			return err
+		}
+		d.k8sConfig.Upstreams = append(d.k8sConfig.Upstreams, upstreams...)
+	}
+	if d.k8sConfig.Intercept != "" {
+		d.redirectUpstreams()
+		log.Info("Deploying service for the pods of the intercepted service", "name", d.k8sConfig.OriginalServiceName(), "namespace", d.k8sConfig.Namespace)
+		if tmpl, err = executeTemplate(OriginalService, d.k8sConfig); err != nil {
+			return err
+		}
+		if err = d.deploy(ctx, tmpl); err != nil {
+			log.Error("Error deploying remote components", "err", err)
+			return err
+		}
+	}
+	if d.k8sConfig.Intercept == "" {
+		log.Info("Deploying new namespace", "name", d.k8sConfig.Namespace)
+		tmpl, err = executeTemplate(Namespace, d.k8sConfig)
+		if err != nil {
+			return err
+		}
+		if err = d.deploy(ctx, tmpl); err != nil {
+			log.Error("Error deploying remote components", "err", err)
+			return err
+		}
+	}
+	if d.k8sConfig.SelfDestruct && d.k8sConfig.Intercept != "" {
+		log.Info("Deploying service account allowed to restore the intercepted service", "namespace", d.k8sConfig.Namespace)
+		if tmpl, err = executeTemplate(ServiceAccount, d.k8sConfig); err != nil {
+			return err
+		}
+		if err = d.deploy(ctx, tmpl); err != nil {
+			log.Error("Error deploying remote components", "err", err)
+			return err
+		}
+		sa, err := d.client.Resource(serviceAccountRes).Namespace(d.k8sConfig.Namespace).Get(ctx, d.k8sConfig.ResourceName(), metav1.GetOptions{})
+		if err != nil {
+			log.Error("Error deploying remote components", "err", err)
+			return err
+		}
+		d.k8sConfig.ServiceAccountUID = string(sa.GetUID())
+		for _, name := range []string{Role, RoleBinding} {
+			if tmpl, err = executeTemplate(name, d.k8sConfig); err != nil {
+				return err
+			}
+			if err = d.deploy(ctx, tmpl); err != nil {
+				log.Error("Error deploying remote components", "err", err)
+				return err
+			}
+		}
+	} else if d.k8sConfig.SelfDestruct {
+		log.Info("Deploying service account allowed to delete the namespace", "namespace", d.k8sConfig.Namespace)
+		ns, err := d.client.Resource(namespaceRes).Get(ctx, d.k8sConfig.Namespace, metav1.GetOptions{})
+		if err != nil {
+			log.Error("Error deploying remote components", "err", err)
+			return err
+		}
+		d.k8sConfig.NamespaceUID = string(ns.GetUID())
+		for _, name := range []string{ServiceAccount, ClusterRole, ClusterRoleBinding} {
+			if tmpl, err = executeTemplate(name, d.k8sConfig); err != nil {
+				return err
+			}
+			if err = d.deploy(ctx, tmpl); err != nil {
+				log.Error("Error deploying remote components", "err", err)
+				return err
+			}
+		}
+	}
+	log.Info("Deploying new secret", "namespace", d.k8sConfig.Namespace)
+	tmpl, err = executeTemplate(Secret, d.k8sConfig)
 	if err != nil {
 		return err
 	}
@@ -158,6 +359,10 @@ func (d Deployer) DeployRemoteComponents(ctx context.Context) error {
 		log.Error("Error deploying remote components", "err", err)
 		return err
 	}
+	if d.k8sConfig.Intercept != "" {
+		// the intercepted service is used instead
+		return nil
+	}
 	log.Info("Deploying new service", "namespace", d.k8sConfig.Namespace)
 	tmpl, err = executeTemplate(Service, d.k8sConfig)
 	if err != nil {
@@ -170,31 +375,67 @@ func (d Deployer) DeployRemoteComponents(ctx context.Context) error {
 	return nil
 }
 
-func (d Deployer) getPodName(ctx context.Context, k8sConfig Config) string {
-	log.Info("Getting pod details")
-	for {
-		namespaceRes := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-		list, err := d.client.Resource(namespaceRes).Namespace(k8sConfig.Namespace).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			log.Warn("Error getting pod list", "err", err)
+// resolveFallbackService returns upstreams pointing to the fallback service for all the mapped tcp service
+// ports which do not have an upstream yet. The service port with the same number is used if the service has
+// one, otherwise its only port is used.
+func (d *Deployer) resolveFallbackService(ctx context.Context) ([]string, error) {
+	namespace, name, found := strings.Cut(d.k8sConfig.FallbackService, "/")
+	if !found {
+		// a namespace created for the session has no services to fall back to
+		namespace, name = d.contextNamespace, namespace
+		if d.k8sConfig.Intercept != "" {
+			namespace = d.k8sConfig.Namespace
 		}
-		for _, u := range list.Items {
-			podStatus, _, err := unstructured.NestedFieldCopy(u.Object, "status", "phase")
-			if err != nil {
-				log.Warn("Error getting pod details", "err", err)
-			}
-			if podStatus == "Running" {
-				podName := u.GetName()
-				log.Info("Pod is Running", "name", podName)
-				return podName
-			}
+	}
+	svc, err := d.client.Resource(serviceRes).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := unstructured.NestedString(svc.Object, "spec", "clusterIP")
+	if host == "" || host == "None" {
+		host = fmt.Sprintf("%s.%s.svc", name, namespace)
+	}
+	var tcpPorts []string
+	ports, _, _ := unstructured.NestedSlice(svc.Object, "spec", "ports")
+	for _, p := range ports {
+		port, ok := p.(map[string]interface{})
+		if !ok {
+			continue
 		}
-		time.Sleep(time.Second * 2)
-		log.Info("Pod not ready yet")
+		if protocol, _, _ := unstructured.NestedString(port, "protocol"); protocol != "" && protocol != "TCP" {
+			continue
+		}
+		number, _, _ := unstructured.NestedInt64(port, "port")
+		tcpPorts = append(tcpPorts, strconv.FormatInt(number, 10))
 	}
+	explicit, err := remote.ParseUpstreams(d.k8sConfig.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []string
+	for _, m := range d.k8sConfig.Mappings {
+		if m.Protocol != mapping.ProtocolTCP || remote.UpstreamFor(explicit, m.ServicePort) != "" {
+			continue
+		}
+		port := ""
+		if slices.Contains(tcpPorts, m.ServicePort) {
+			port = m.ServicePort
+		} else if len(tcpPorts) == 1 {
+			port = tcpPorts[0]
+		} else {
+			log.Warn("No matching port in fallback service", "service", d.k8sConfig.FallbackService, "servicePort", m.ServicePort)
+			continue
+		}
+		upstream := fmt.Sprintf("%s=%s", m.ServicePort, net.JoinHostPort(host, port))
+		log.Info("Using fallback upstream", "servicePort", m.ServicePort, "upstream", upstream)
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
 }
 
-func (d Deployer) ForwardPorts(ctx context.Context, ports ...string) (chan chan struct{}, error) {
+// ForwardPorts forwards the ports of the pod. Once forwarding stops, the ports of the next ready pod of the
+// session are forwarded, until the context is done.
+func (d *Deployer) ForwardPorts(ctx context.Context, podName string, ports ...string) (chan chan struct{}, error) {
 	transport, upgrader, err := spdy.RoundTripperFor(d.config)
 	if err != nil {
 		return nil, err
@@ -204,9 +445,19 @@ func (d Deployer) ForwardPorts(ctx context.Context, ports ...string) (chan chan
 		return nil, err
 	}
 	readChanChan := make(chan chan struct{})
-	go func() {
-		for {
-			podName := d.getPodName(ctx, d.k8sConfig)
+	d.spawn(func() {
+		for ctx.Err() == nil {
+			if podName == "" {
+				var err error
+				if podName, err = d.waitForPod(ctx); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Error("Remote pod did not become ready. Retrying", "err", err)
+					time.Sleep(time.Second * 5)
+					continue
+				}
+			}
 			url.Path = path.Join("api", "v1", "namespaces", d.k8sConfig.Namespace, "pods", podName, "portforward")
 			dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
 			var formattedPorts []string
@@ -215,7 +466,7 @@ func (d Deployer) ForwardPorts(ctx context.Context, ports ...string) (chan chan
 			}
 			readyChan := make(chan struct{})
 			readChanChan <- readyChan
-			forwarder, err := portforward.New(dialer, formattedPorts, nil, readyChan, io.Discard, os.Stderr)
+			forwarder, err := portforward.New(dialer, formattedPorts, ctx.Done(), readyChan, io.Discard, os.Stderr)
 			if err != nil {
 				log.Error("Error creating new forwarder. Retrying", "err", err)
 			} else {
@@ -223,12 +474,22 @@ func (d Deployer) ForwardPorts(ctx context.Context, ports ...string) (chan chan
 					log.Error("Error forwarding ports. Retrying", "err", err)
 				}
 			}
+			podName = ""
 			time.Sleep(time.Second * 5)
 		}
-	}()
+	})
 	return readChanChan, nil
 }
 
+// spawn runs f in a new goroutine with Spawn.
+func (d *Deployer) spawn(f func()) {
+	if d.k8sConfig.Spawn == nil {
+		go f()
+		return
+	}
+	d.k8sConfig.Spawn(f)
+}
+
 var connectionDetailsStyle = lipgloss.NewStyle().
 	Border(lipgloss.NormalBorder()).
 	Foreground(lipgloss.AdaptiveColor{Light: "236", Dark: "253"}).
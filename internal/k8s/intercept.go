@@ -0,0 +1,313 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/mapping"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	LabelSession = "reversepf.io/session"
+	// annotationInterceptedBy records the session which currently owns the selector of an intercepted service
+	annotationInterceptedBy = "reversepf.io/intercepted-by"
+	// annotationOriginalSelector records the selector of an intercepted service, as json, so that it can be
+	// restored even if the run which changed it crashed
+	annotationOriginalSelector = "reversepf.io/original-selector"
+)
+
+var (
+	serviceRes    = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "services"}
+	secretRes     = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	deploymentRes = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	// serviceAccountRes is only deployed with SelfDestruct. It owns the role and binding allowing the remote
+	// component to clean up, so it is deleted last
+	serviceAccountRes = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "serviceaccounts"}
+)
+
+type ContainerPort struct {
+	Name     string
+	Port     string
+	Protocol string
+}
+
+// ServicePort is a port of the intercepted service. TargetPort is a number or the name of a container port.
+type ServicePort struct {
+	Name       string
+	Port       string
+	TargetPort string
+	Protocol   string
+}
+
+// ParseInterceptTarget returns the name of the service to intercept. The name can be prefixed with svc/ or service/.
+func ParseInterceptTarget(target string) (string, error) {
+	kind, name, found := strings.Cut(target, "/")
+	if !found {
+		kind, name = "svc", kind
+	}
+	if kind != "svc" && kind != "service" && kind != "services" {
+		return "", fmt.Errorf("only services can be intercepted, got %q", target)
+	}
+	if name == "" {
+		return "", fmt.Errorf("missing service name in %q", target)
+	}
+	return name, nil
+}
+
+// prepareIntercept matches the mappings with the ports of the intercepted service. The mappings are changed to
+// listen on the target ports of the service, so that the remote component can replace the pods of the service
+// by only changing its selector.
+func (d *Deployer) prepareIntercept(ctx context.Context) error {
+	namespace, name := d.k8sConfig.Namespace, d.k8sConfig.Intercept
+	svc, err := d.client.Resource(serviceRes).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	selector, _, _ := unstructured.NestedStringMap(svc.Object, "spec", "selector")
+	if len(selector) == 0 {
+		return fmt.Errorf("service %s/%s has no selector", namespace, name)
+	}
+	if original, ok := svc.GetAnnotations()[annotationOriginalSelector]; ok {
+		// the service is still pointed at the pod of an earlier session
+		selector = nil
+		if err := json.Unmarshal([]byte(original), &selector); err != nil {
+			return fmt.Errorf("invalid original selector of service %s/%s: %w", namespace, name, err)
+		}
+	}
+	if owner := svc.GetAnnotations()[annotationInterceptedBy]; owner != "" && owner != d.k8sConfig.Session {
+		_, err := d.client.Resource(deploymentRes).Namespace(namespace).Get(ctx, d.k8sConfig.AppName+"-"+owner, metav1.GetOptions{})
+		if err == nil {
+			return fmt.Errorf("service %s/%s is already intercepted by session %s", namespace, name, owner)
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Warn("Service was intercepted by a session which no longer exists. Taking over", "service", name, "session", owner)
+	}
+	ports, _, _ := unstructured.NestedSlice(svc.Object, "spec", "ports")
+	var (
+		mappings       []mapping.Mapping
+		containerPorts []ContainerPort
+		originalPorts  []ServicePort
+		addrs          []string
+	)
+	for _, p := range ports {
+		port, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		number, _, _ := unstructured.NestedInt64(port, "port")
+		portName, _, _ := unstructured.NestedString(port, "name")
+		protocol, _, _ := unstructured.NestedString(port, "protocol")
+		if protocol == "" {
+			protocol = "TCP"
+		}
+		targetPort := fmt.Sprint(port["targetPort"])
+		if port["targetPort"] == nil {
+			targetPort = strconv.FormatInt(number, 10)
+		}
+		originalPorts = append(originalPorts, ServicePort{Name: portName, Port: strconv.FormatInt(number, 10), TargetPort: targetPort, Protocol: protocol})
+	}
+	for _, m := range d.k8sConfig.Mappings {
+		port := findServicePort(ports, m.ServicePort, m.KubeProtocol())
+		if port == nil && len(ports) == 1 && len(d.k8sConfig.Mappings) == 1 {
+			port = ports[0].(map[string]interface{})
+		}
+		if port == nil {
+			return fmt.Errorf("service %s/%s has no %s port %s", namespace, name, m.KubeProtocol(), m.ServicePort)
+		}
+		number, _, _ := unstructured.NestedInt64(port, "port")
+		servicePort := strconv.FormatInt(number, 10)
+		addrs = append(addrs, fmt.Sprintf("%s.%s:%s/%s", name, namespace, servicePort, m.Protocol))
+		switch target := port["targetPort"].(type) {
+		case string:
+			// a named target port is resolved through the ports of the container
+			containerPorts = append(containerPorts, ContainerPort{Name: target, Port: servicePort, Protocol: m.KubeProtocol()})
+			m.ServicePort = servicePort
+		case int64:
+			m.ServicePort = strconv.FormatInt(target, 10)
+		default:
+			m.ServicePort = servicePort
+		}
+		for _, other := range mappings {
+			if other.ServicePortSpec() == m.ServicePortSpec() {
+				return fmt.Errorf("service %s/%s sends more than one forwarded port to %s", namespace, name, m.ServicePortSpec())
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	if len(ports) > len(mappings) {
+		log.Warn("Not all the ports of the service are forwarded. Connections to those ports fail while the service is intercepted", "service", name)
+	}
+	d.k8sConfig.Mappings = mappings
+	d.k8sConfig.ContainerPorts = containerPorts
+	d.k8sConfig.OriginalSelector = selector
+	d.k8sConfig.OriginalPorts = originalPorts
+	d.addrs = addrs
+	d.interceptHosts = []string{name, name + "." + namespace, name + "." + namespace + ".svc", name + "." + namespace + ".svc.cluster.local"}
+	if clusterIP, _, _ := unstructured.NestedString(svc.Object, "spec", "clusterIP"); clusterIP != "" && clusterIP != "None" {
+		d.interceptHosts = append(d.interceptHosts, clusterIP)
+	}
+	return nil
+}
+
+// redirectUpstreams points the upstreams at the intercepted service to the original service instead. The
+// intercepted service sends the connections back to the remote component, so they would loop.
+func (d *Deployer) redirectUpstreams() {
+	original := d.k8sConfig.OriginalServiceName() + "." + d.k8sConfig.Namespace + ".svc"
+	for i, spec := range d.k8sConfig.Upstreams {
+		servicePort, addr, found := strings.Cut(spec, "=")
+		if !found {
+			servicePort, addr = "", spec
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || !slices.Contains(d.interceptHosts, strings.TrimSuffix(host, ".")) {
+			continue
+		}
+		addr = net.JoinHostPort(original, port)
+		if found {
+			addr = servicePort + "=" + addr
+		}
+		log.Info("Sending upstream to the pods of the intercepted service", "upstream", spec, "via", addr)
+		d.k8sConfig.Upstreams[i] = addr
+	}
+}
+
+func findServicePort(ports []interface{}, servicePort, protocol string) map[string]interface{} {
+	for _, p := range ports {
+		port, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		number, _, _ := unstructured.NestedInt64(port, "port")
+		portProtocol, _, _ := unstructured.NestedString(port, "protocol")
+		if portProtocol == "" {
+			portProtocol = "TCP"
+		}
+		if strconv.FormatInt(number, 10) == servicePort && portProtocol == protocol {
+			return port
+		}
+	}
+	return nil
+}
+
+// interceptService points the selector of the intercepted service at the pod of this session. The original
+// selector is recorded in an annotation, unless the service is already intercepted and the annotation has it.
+func (d *Deployer) interceptService(ctx context.Context) error {
+	namespace, name := d.k8sConfig.Namespace, d.k8sConfig.Intercept
+	svc, err := d.client.Resource(serviceRes).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	current, _, _ := unstructured.NestedStringMap(svc.Object, "spec", "selector")
+	original, intercepted := svc.GetAnnotations()[annotationOriginalSelector]
+	if !intercepted {
+		data, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		original = string(data)
+	}
+	selector := make(map[string]interface{})
+	for k := range current {
+		selector[k] = nil
+	}
+	selector["app"] = d.k8sConfig.AppName
+	selector[LabelSession] = d.k8sConfig.Session
+	log.Info("Intercepting service", "service", name, "namespace", namespace)
+	return d.patchService(ctx, namespace, name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				annotationInterceptedBy:    d.k8sConfig.Session,
+				annotationOriginalSelector: original,
+			},
+		},
+		"spec": map[string]interface{}{
+			"selector": selector,
+		},
+	})
+}
+
+// restoreService restores the selector recorded while intercepting the service. Services intercepted by
+// other sessions are left untouched.
+func (d *Deployer) restoreService(ctx context.Context) error {
+	namespace, name := d.k8sConfig.Namespace, d.k8sConfig.Intercept
+	svc, err := d.client.Resource(serviceRes).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	annotations := svc.GetAnnotations()
+	if owner := annotations[annotationInterceptedBy]; owner != d.k8sConfig.Session {
+		log.Warn("Service is not intercepted by this session. Leaving it as it is", "service", name, "session", owner)
+		return nil
+	}
+	var original map[string]string
+	if err := json.Unmarshal([]byte(annotations[annotationOriginalSelector]), &original); err != nil {
+		return fmt.Errorf("invalid original selector: %w", err)
+	}
+	current, _, _ := unstructured.NestedStringMap(svc.Object, "spec", "selector")
+	selector := make(map[string]interface{})
+	for k := range current {
+		selector[k] = nil
+	}
+	for k, v := range original {
+		selector[k] = v
+	}
+	log.Info("Restoring service", "service", name, "namespace", namespace, "selector", original)
+	return d.patchService(ctx, namespace, name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				annotationInterceptedBy:    nil,
+				annotationOriginalSelector: nil,
+			},
+		},
+		"spec": map[string]interface{}{
+			"selector": selector,
+		},
+	})
+}
+
+func (d *Deployer) patchService(ctx context.Context, namespace, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.Resource(serviceRes).Namespace(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{
+		FieldManager: d.k8sConfig.AppName + "-k8s",
+	})
+	return err
+}
+
+// cleanupIntercept gives the service back to its pods before removing the resources of this session. The
+// namespace belongs to the service and is kept. It also runs in the remote component for SelfDestruct.
+func (d *Deployer) cleanupIntercept(ctx context.Context) {
+	if err := d.restoreService(ctx); err != nil {
+		log.Error("Unable to restore intercepted service. Please restore its selector manually", "service", d.k8sConfig.Intercept, "err", err)
+	}
+	namespace := d.k8sConfig.Namespace
+	for _, r := range []struct {
+		res  schema.GroupVersionResource
+		name string
+	}{
+		{deploymentRes, d.k8sConfig.ResourceName()},
+		{secretRes, d.k8sConfig.ResourceName()},
+		{serviceRes, d.k8sConfig.OriginalServiceName()},
+		{serviceAccountRes, d.k8sConfig.ResourceName()},
+	} {
+		err := d.client.Resource(r.res).Namespace(namespace).Delete(ctx, r.name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Error("Unable to do cleanup. Please do the cleanup manually", "resource", r.res.Resource, "name", r.name, "err", err)
+		}
+	}
+}
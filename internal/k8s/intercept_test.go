@@ -0,0 +1,231 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/mapping"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// testService returns the service web of the test namespace with a port 80 to 8080 and a port 9090 to the
+// named port grpc.
+func testService(selector map[string]interface{}, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":        "web",
+			"namespace":   "reversepf-test",
+			"annotations": annotations,
+		},
+		"spec": map[string]interface{}{
+			"clusterIP": "10.0.0.10",
+			"selector":  selector,
+			"ports": []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80), "targetPort": int64(8080), "protocol": "TCP"},
+				map[string]interface{}{"name": "grpc", "port": int64(9090), "targetPort": "grpc", "protocol": "TCP"},
+			},
+		},
+	}}
+}
+
+// testObject returns a namespaced object of the test namespace.
+func testObject(apiVersion, kind, name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "reversepf-test"},
+	}}
+}
+
+func interceptDeployer(t *testing.T, objects ...runtime.Object) *Deployer {
+	t.Helper()
+	d := testDeployer(time.Second, objects...)
+	d.k8sConfig.Intercept = "web"
+	for _, spec := range []string{"3000:80", "3001:9090"} {
+		m, err := mapping.Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.k8sConfig.Mappings = append(d.k8sConfig.Mappings, m)
+	}
+	return d
+}
+
+func getService(t *testing.T, d *Deployer) *unstructured.Unstructured {
+	t.Helper()
+	svc, err := d.client.Resource(serviceRes).Namespace("reversepf-test").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestPrepareIntercept(t *testing.T) {
+	d := interceptDeployer(t, testService(map[string]interface{}{"app": "web"}, nil))
+	if err := d.prepareIntercept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var specs []string
+	for _, m := range d.k8sConfig.Mappings {
+		specs = append(specs, m.ServicePortSpec())
+	}
+	// the remote component listens on the target ports, and on the service port for a named target port
+	if want := []string{"8080/tcp", "9090/tcp"}; !reflect.DeepEqual(specs, want) {
+		t.Errorf("service ports = %v, want %v", specs, want)
+	}
+	if want := []ContainerPort{{Name: "grpc", Port: "9090", Protocol: "TCP"}}; !reflect.DeepEqual(d.k8sConfig.ContainerPorts, want) {
+		t.Errorf("container ports = %v, want %v", d.k8sConfig.ContainerPorts, want)
+	}
+	if want := map[string]string{"app": "web"}; !reflect.DeepEqual(d.k8sConfig.OriginalSelector, want) {
+		t.Errorf("original selector = %v, want %v", d.k8sConfig.OriginalSelector, want)
+	}
+	if want := []string{"web.reversepf-test:80/tcp", "web.reversepf-test:9090/tcp"}; !reflect.DeepEqual(d.addrs, want) {
+		t.Errorf("addrs = %v, want %v", d.addrs, want)
+	}
+}
+
+func TestPrepareInterceptErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		service *unstructured.Unstructured
+		objects []runtime.Object
+		want    string
+	}{
+		{
+			name:    "no selector",
+			service: testService(nil, nil),
+			want:    "service reversepf-test/web has no selector",
+		},
+		{
+			name: "intercepted by a live session",
+			service: testService(map[string]interface{}{"app": "reversepf", LabelSession: "other"}, map[string]interface{}{
+				annotationInterceptedBy:    "other",
+				annotationOriginalSelector: `{"app":"web"}`,
+			}),
+			objects: []runtime.Object{testObject("apps/v1", "Deployment", "reversepf-other")},
+			want:    "service reversepf-test/web is already intercepted by session other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := interceptDeployer(t, append(tt.objects, tt.service)...)
+			if err := d.prepareIntercept(context.Background()); err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareInterceptTakesOverCrashedSession(t *testing.T) {
+	// the session which crashed left the service pointed at its pod
+	d := interceptDeployer(t, testService(map[string]interface{}{"app": "reversepf", LabelSession: "other"}, map[string]interface{}{
+		annotationInterceptedBy:    "other",
+		annotationOriginalSelector: `{"app":"web"}`,
+	}))
+	if err := d.prepareIntercept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"app": "web"}; !reflect.DeepEqual(d.k8sConfig.OriginalSelector, want) {
+		t.Errorf("original selector = %v, want %v", d.k8sConfig.OriginalSelector, want)
+	}
+}
+
+func TestInterceptAndRestoreService(t *testing.T) {
+	d := interceptDeployer(t, testService(map[string]interface{}{"app": "web", "tier": "frontend"}, nil))
+	ctx := context.Background()
+	if err := d.interceptService(ctx); err != nil {
+		t.Fatal(err)
+	}
+	svc := getService(t, d)
+	selector, _, _ := unstructured.NestedStringMap(svc.Object, "spec", "selector")
+	if want := map[string]string{"app": "reversepf", LabelSession: "test"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("intercepted selector = %v, want %v", selector, want)
+	}
+	var original map[string]string
+	if err := json.Unmarshal([]byte(svc.GetAnnotations()[annotationOriginalSelector]), &original); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"app": "web", "tier": "frontend"}; !reflect.DeepEqual(original, want) {
+		t.Errorf("recorded selector = %v, want %v", original, want)
+	}
+	// intercepting again, as a restarted run does, keeps the recorded selector
+	if err := d.interceptService(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := getService(t, d).GetAnnotations()[annotationOriginalSelector]; got != svc.GetAnnotations()[annotationOriginalSelector] {
+		t.Errorf("recorded selector after intercepting again = %s, want %s", got, svc.GetAnnotations()[annotationOriginalSelector])
+	}
+
+	if err := d.restoreService(ctx); err != nil {
+		t.Fatal(err)
+	}
+	svc = getService(t, d)
+	selector, _, _ = unstructured.NestedStringMap(svc.Object, "spec", "selector")
+	if want := map[string]string{"app": "web", "tier": "frontend"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("restored selector = %v, want %v", selector, want)
+	}
+	if annotations := svc.GetAnnotations(); annotations[annotationInterceptedBy] != "" || annotations[annotationOriginalSelector] != "" {
+		t.Errorf("annotations after restoring = %v, want none of the intercept", annotations)
+	}
+}
+
+func TestRestoreServiceOfOtherSession(t *testing.T) {
+	intercepted := map[string]interface{}{"app": "reversepf", LabelSession: "other"}
+	d := interceptDeployer(t, testService(intercepted, map[string]interface{}{
+		annotationInterceptedBy:    "other",
+		annotationOriginalSelector: `{"app":"web"}`,
+	}))
+	if err := d.restoreService(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	selector, _, _ := unstructured.NestedMap(getService(t, d).Object, "spec", "selector")
+	if !reflect.DeepEqual(selector, intercepted) {
+		t.Errorf("selector = %v, want it left as %v", selector, intercepted)
+	}
+}
+
+func TestSelfDestructIntercept(t *testing.T) {
+	d := interceptDeployer(t,
+		testService(map[string]interface{}{"app": "web"}, nil),
+		testObject("apps/v1", "Deployment", "reversepf-test"),
+		testObject("v1", "Secret", "reversepf-test"),
+		testObject("v1", "Service", "web-test-original"),
+		testObject("v1", "ServiceAccount", "reversepf-test"),
+	)
+	ctx := context.Background()
+	if err := d.interceptService(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the remote component only knows the session it belongs to
+	config := Config{AppName: "reversepf", Namespace: "reversepf-test", Intercept: "web", Session: "test"}
+	if err := selfDestruct(ctx, d.client, config); err != nil {
+		t.Fatal(err)
+	}
+	selector, _, _ := unstructured.NestedStringMap(getService(t, d).Object, "spec", "selector")
+	if want := map[string]string{"app": "web"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("selector = %v, want %v", selector, want)
+	}
+	for _, r := range []struct {
+		res  schema.GroupVersionResource
+		name string
+	}{
+		{deploymentRes, "reversepf-test"},
+		{secretRes, "reversepf-test"},
+		{serviceRes, "web-test-original"},
+		{serviceAccountRes, "reversepf-test"},
+	} {
+		_, err := d.client.Resource(r.res).Namespace("reversepf-test").Get(ctx, r.name, metav1.GetOptions{})
+		if !apierrors.IsNotFound(err) {
+			t.Errorf("%s %s: err = %v, want it deleted", r.res.Resource, r.name, err)
+		}
+	}
+}
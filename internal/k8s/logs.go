@@ -0,0 +1,174 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// LogMode decides which lines of the remote component logs are shown locally.
+type LogMode string
+
+const (
+	// LogsOff does not show the remote logs
+	LogsOff LogMode = "off"
+	// LogsErrors shows the errors and panics of the remote component
+	LogsErrors LogMode = "errors"
+	// LogsAll shows every line of the remote logs
+	LogsAll LogMode = "all"
+)
+
+func ParseLogMode(mode string) (LogMode, error) {
+	switch m := LogMode(mode); m {
+	case LogsOff, LogsErrors, LogsAll:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown remote logs mode %q. Must be one of off, errors or all", mode)
+	}
+}
+
+var remoteLogPrefix = lipgloss.NewStyle().
+	Foreground(lipgloss.AdaptiveColor{Light: "99", Dark: "141"}).
+	Render("[remote]")
+
+// remoteLogFilter decides which lines of a container log are shown.
+type remoteLogFilter struct {
+	mode LogMode
+	// panicking is set once the container panics, after which the whole trace is shown
+	panicking bool
+}
+
+func (f *remoteLogFilter) show(line string) bool {
+	if f.mode == LogsAll || f.panicking {
+		return true
+	}
+	if strings.HasPrefix(line, "panic:") || strings.HasPrefix(line, "fatal error:") {
+		f.panicking = true
+		return true
+	}
+	// lines look like `2006/01/02 15:04:05 ERRO [PREFIX] message`
+	fields := strings.Fields(line)
+	for i := 0; i < len(fields) && i < 3; i++ {
+		if fields[i] == "ERRO" || fields[i] == "FATA" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamLogs follows the logs of the remote component and prints them under a distinct prefix until the context
+// is done. The newest pod of the session is followed, so the logs continue across container and pod restarts.
+func (d *Deployer) streamLogs(ctx context.Context) {
+	mode := LogMode(d.k8sConfig.RemoteLogs)
+	if mode == "" || mode == LogsOff {
+		return
+	}
+	httpClient, err := rest.HTTPClientFor(d.config)
+	if err != nil {
+		log.Error("Unable to stream remote logs", "err", err)
+		return
+	}
+	since := d.deployedAt
+	for ctx.Err() == nil {
+		podName, err := d.newestPod(ctx)
+		if err != nil {
+			log.Debug("Unable to find pod for remote logs", "err", err)
+		} else if podName != "" {
+			if since, err = d.followLogs(ctx, httpClient, podName, mode, since); err != nil {
+				log.Debug("Unable to follow remote logs", "pod", podName, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 2):
+		}
+	}
+}
+
+// newestPod returns the name of the most recently created pod of this session which is not being deleted.
+func (d *Deployer) newestPod(ctx context.Context) (string, error) {
+	list, err := d.client.Resource(podRes).Namespace(d.k8sConfig.Namespace).List(ctx, metav1.ListOptions{LabelSelector: d.podSelector()})
+	if err != nil {
+		return "", err
+	}
+	var (
+		name    string
+		created time.Time
+	)
+	for _, pod := range list.Items {
+		if pod.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if t := pod.GetCreationTimestamp().Time; name == "" || t.After(created) {
+			name, created = pod.GetName(), t
+		}
+	}
+	return name, nil
+}
+
+// followLogs prints the logs of the current container of the pod written after since, until the container
+// stops. It returns the time of the last line printed, from which the next container is followed.
+func (d *Deployer) followLogs(ctx context.Context, httpClient *http.Client, podName string, mode LogMode, since time.Time) (time.Time, error) {
+	u, err := url.Parse(d.config.Host)
+	if err != nil {
+		return since, err
+	}
+	u.Path = path.Join(u.Path, "api", "v1", "namespaces", d.k8sConfig.Namespace, "pods", podName, "log")
+	query := url.Values{}
+	query.Set("container", d.k8sConfig.AppName)
+	query.Set("follow", "true")
+	query.Set("timestamps", "true")
+	if !since.IsZero() {
+		query.Set("sinceTime", since.UTC().Format(time.RFC3339))
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return since, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return since, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the container is not started yet, or the pod is gone
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return since, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return printLogs(resp.Body, os.Stderr, &remoteLogFilter{mode: mode}, since)
+}
+
+// printLogs prints the lines of a log with timestamps written after since, which pass the filter. It returns the
+// time of the last line read.
+func printLogs(r io.Reader, w io.Writer, filter *remoteLogFilter, since time.Time) (time.Time, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		timestamp, line, _ := strings.Cut(scanner.Text(), " ")
+		at, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err == nil {
+			// sinceTime has a precision of seconds, so lines already printed are sent again
+			if !at.After(since) {
+				continue
+			}
+			since = at
+		}
+		if filter.show(line) {
+			fmt.Fprintln(w, remoteLogPrefix, line)
+		}
+	}
+	return since, scanner.Err()
+}
@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteLogFilter(t *testing.T) {
+	lines := []string{
+		"2026/10/16 10:00:00 INFO [SERVICE]: New proxy established",
+		"2026/10/16 10:00:01 WARN [SERVICE]: Connection closed",
+		"2026/10/16 10:00:02 ERRO [CONTROL]: Error opening stream",
+		"2026/10/16 10:00:03 INFO ERRO in the message is not a level",
+		"2026/10/16 10:00:04 FATA Error starting listener",
+		"panic: runtime error: invalid memory address",
+		"goroutine 1 [running]:",
+		"main.main()",
+	}
+	tests := []struct {
+		mode LogMode
+		want []int
+	}{
+		{mode: LogsAll, want: []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		// the whole trace of a panic is shown
+		{mode: LogsErrors, want: []int{2, 4, 5, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			filter := &remoteLogFilter{mode: tt.mode}
+			var shown []int
+			for i, line := range lines {
+				if filter.show(line) {
+					shown = append(shown, i)
+				}
+			}
+			if !slices.Equal(shown, tt.want) {
+				t.Errorf("shown lines %v, want %v", shown, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintLogs(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		name   string
+		errors bool
+		since  time.Time
+		log    string
+		want   []string
+		last   time.Time
+	}{
+		{
+			name: "first container",
+			log: "2026-10-16T10:00:00.100Z ERRO first\n" +
+				"2026-10-16T10:00:00.200Z INFO second\n",
+			want: []string{"ERRO first", "INFO second"},
+			last: at("2026-10-16T10:00:00.200Z"),
+		},
+		{
+			// after a reconnect, the lines of the second of since are sent again
+			name:  "repeated after reconnect",
+			since: at("2026-10-16T10:00:00.200Z"),
+			log: "2026-10-16T10:00:00.100Z ERRO first\n" +
+				"2026-10-16T10:00:00.200Z INFO second\n" +
+				"2026-10-16T10:00:00.300Z INFO third\n",
+			want: []string{"INFO third"},
+			last: at("2026-10-16T10:00:00.300Z"),
+		},
+		{
+			name:  "nothing new",
+			since: at("2026-10-16T10:00:00.300Z"),
+			log:   "2026-10-16T10:00:00.300Z INFO third\n",
+			last:  at("2026-10-16T10:00:00.300Z"),
+		},
+		{
+			name:   "errors only",
+			errors: true,
+			log: "2026-10-16T10:00:00.100Z ERRO first\n" +
+				"2026-10-16T10:00:00.200Z INFO second\n",
+			want: []string{"ERRO first"},
+			last: at("2026-10-16T10:00:00.200Z"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &remoteLogFilter{mode: LogsAll}
+			if tt.errors {
+				filter.mode = LogsErrors
+			}
+			var out bytes.Buffer
+			last, err := printLogs(strings.NewReader(tt.log), &out, filter, tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var printed []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if line != "" {
+					printed = append(printed, strings.TrimPrefix(line, remoteLogPrefix+" "))
+				}
+			}
+			if !slices.Equal(printed, tt.want) {
+				t.Errorf("printed %q, want %q", printed, tt.want)
+			}
+			if !last.Equal(tt.last) {
+				t.Errorf("last = %s, want %s", last, tt.last)
+			}
+		})
+	}
+}
@@ -2,23 +2,63 @@ package k8s
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/certs"
+	"github.com/v4run/reversepf/internal/mapping"
 )
 
-var tmplt = template.New("k8s-manifests")
+var tmplt = template.New("k8s-manifests").Funcs(template.FuncMap{
+	"base64": base64.StdEncoding.EncodeToString,
+	"quote":  strconv.Quote,
+})
 
 func init() {
+	if _, err := tmplt.New(Metadata).Parse(metadata); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "Metadata")
+	}
+	if _, err := tmplt.New(NamespaceOwner).Parse(namespaceOwner); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "NamespaceOwner")
+	}
+	if _, err := tmplt.New(ServiceAccountOwner).Parse(serviceAccountOwner); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "ServiceAccountOwner")
+	}
 	if _, err := tmplt.New(Namespace).Parse(namespace); err != nil {
 		log.Fatal("Error parsing template", "err", err, "template", "Namespace")
 	}
 	if _, err := tmplt.New(Service).Parse(service); err != nil {
 		log.Fatal("Error parsing template", "err", err, "template", "Service")
 	}
+	if _, err := tmplt.New(OriginalService).Parse(originalService); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "OriginalService")
+	}
 	if _, err := tmplt.New(Deployment).Parse(deployment); err != nil {
 		log.Fatal("Error parsing template", "err", err, "template", "Deployment")
 	}
+	if _, err := tmplt.New(Secret).Parse(secret); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "Secret")
+	}
+	if _, err := tmplt.New(ServiceAccount).Parse(serviceAccount); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "ServiceAccount")
+	}
+	if _, err := tmplt.New(ClusterRole).Parse(clusterRole); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "ClusterRole")
+	}
+	if _, err := tmplt.New(ClusterRoleBinding).Parse(clusterRoleBinding); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "ClusterRoleBinding")
+	}
+	if _, err := tmplt.New(Role).Parse(role); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "Role")
+	}
+	if _, err := tmplt.New(RoleBinding).Parse(roleBinding); err != nil {
+		log.Fatal("Error parsing template", "err", err, "template", "RoleBinding")
+	}
 }
 
 type Config struct {
@@ -26,43 +66,184 @@ type Config struct {
 	Namespace         string
 	Version           string
 	ControlServerPort string
-	PortalPort        string
-	ServicePort       string
+	Mappings          []mapping.Mapping
 	Kubeconfig        string
 	KubeContext       string
+	Token             string
+	ExposeControl     bool
+	TLS               *certs.Bundle
+	GracePeriod       string
+	// MaxPending is the number of connections the remote component holds while waiting for the local component
+	MaxPending    int64
+	OnUnavailable string
+	Upstreams     []string
+	// FallbackService is a service, as [NAMESPACE/]NAME, used to fill the upstreams for the mapped service ports.
+	// Without a namespace, it is looked up next to the intercepted service, or in the namespace of the context
+	FallbackService string
+	// RouteHeader, as HEADER=VALUE, makes the remote component send only the matching http requests to the local
+	// component and the rest to the upstreams
+	RouteHeader string
+	// Mirror is the mirror mode of the remote component
+	Mirror              string
+	AcceptProxyProtocol bool
+	// HealthPort is the port on which the remote component serves the endpoints used by the probes
+	HealthPort          string
+	ReadyRequiresClient bool
+	// ReadyTimeout is how long to wait for the remote pod to become ready
+	ReadyTimeout time.Duration
+	// RemoteLogs is the LogMode deciding which lines of the remote component logs are shown locally
+	RemoteLogs string
+	// MetricsPort is the port on which the remote component serves prometheus metrics, if set
+	MetricsPort string
+	// Intercept is the name of an existing service in Namespace whose traffic is sent to the remote component
+	Intercept string
+	// Session is the name of this run. It tells apart the resources of runs sharing a namespace
+	Session string
+	// ContainerPorts are declared on the remote container for the named target ports of the intercepted service
+	ContainerPorts []ContainerPort
+	// OriginalSelector and OriginalPorts are copied from the intercepted service to the OriginalServiceName
+	// service, which keeps the pods of the intercepted service reachable as upstreams
+	OriginalSelector map[string]string
+	OriginalPorts    []ServicePort
+	// Owner and Host are the user and the machine running the local component
+	Owner string
+	Host  string
+	// CreatedAt is when the remote components were deployed
+	CreatedAt time.Time
+	// TTL is how long the session lives after the local component was last seen, before gc deletes it
+	TTL time.Duration
+	// IdleTimeout makes the remote component exit once no local component is connected for this long
+	IdleTimeout time.Duration
+	// SelfDestruct makes the remote component delete its namespace when it exits for being idle. While
+	// intercepting a service, it restores the service and deletes the resources of the session instead
+	SelfDestruct bool
+	// NamespaceUID is the uid of the namespace, which owns the cluster role and binding of SelfDestruct
+	NamespaceUID string
+	// ServiceAccountUID is the uid of the service account, which owns the role and binding of SelfDestruct
+	// while intercepting a service
+	ServiceAccountUID string
+	// Takeover allows replacing a live session of the same name owned by someone else
+	Takeover bool
+	// Spawn runs the background work of the deployer in a new goroutine, so that the caller can handle its
+	// panics. The go statement is used if nil
+	Spawn func(func())
+}
+
+// ResourceName is the name of the namespaced resources. Runs intercepting a service share the namespace of
+// the service, so the session is made part of the name.
+func (c Config) ResourceName() string {
+	if c.Intercept == "" {
+		return c.AppName
+	}
+	return c.AppName + "-" + c.Session
+}
+
+// OriginalServiceName is the name of the service selecting the pods of the intercepted service while it is
+// intercepted.
+func (c Config) OriginalServiceName() string {
+	return c.Intercept + "-" + c.Session + "-original"
+}
+
+// Created is CreatedAt as recorded in the annotations.
+func (c Config) Created() string {
+	return c.CreatedAt.UTC().Format(time.RFC3339)
+}
+
+// TokenChecksum is added to the pod template so that the pod is recreated whenever the token changes.
+func (c Config) TokenChecksum() string {
+	sum := sha256.Sum256([]byte(c.Token))
+	return hex.EncodeToString(sum[:])
 }
 
 const (
-	Namespace  = "Namespace"
-	Service    = "Service"
-	Deployment = "Deployment"
+	Metadata            = "Metadata"
+	NamespaceOwner      = "NamespaceOwner"
+	ServiceAccountOwner = "ServiceAccountOwner"
+	Namespace           = "Namespace"
+	Service             = "Service"
+	OriginalService     = "OriginalService"
+	Deployment          = "Deployment"
+	Secret              = "Secret"
+	ServiceAccount      = "ServiceAccount"
+	ClusterRole         = "ClusterRole"
+	ClusterRoleBinding  = "ClusterRoleBinding"
+	Role                = "Role"
+	RoleBinding         = "RoleBinding"
 )
 
+// metadata are the labels and annotations of every resource of a session, used to find and expire sessions.
+const metadata = `
+  labels:
+    app: {{.AppName}}
+    app.kubernetes.io/managed-by: {{.AppName}}
+    reversepf.io/session: {{quote .Session}}
+  annotations:
+    reversepf.io/owner: {{quote .Owner}}
+    reversepf.io/host: {{quote .Host}}
+    reversepf.io/created-at: "{{.Created}}"
+    reversepf.io/ttl: "{{.TTL}}"
+  {{- if .Intercept}}
+    reversepf.io/intercept: {{quote .Intercept}}
+  {{- end}}
+  {{- if .SelfDestruct}}
+    reversepf.io/self-destruct: "true"
+  {{- end}}`
+
+// namespaceOwner makes the namespace of the session own a cluster-scoped resource.
+const namespaceOwner = `
+  ownerReferences:
+    - apiVersion: v1
+      kind: Namespace
+      name: {{.Namespace}}
+      uid: "{{.NamespaceUID}}"`
+
+// serviceAccountOwner makes the service account of the remote component own a resource of the session.
+const serviceAccountOwner = `
+  ownerReferences:
+    - apiVersion: v1
+      kind: ServiceAccount
+      name: {{.ResourceName}}
+      uid: "{{.ServiceAccountUID}}"`
+
 const namespace = `
 apiVersion: v1
 kind: Namespace
 metadata:
   name: {{.Namespace}}
+{{- template "Metadata" .}}
 `
 
 const deployment = `
 apiVersion: apps/v1
 kind: Deployment
 metadata:
-  name: {{.AppName}}
+  name: {{.ResourceName}}
   namespace: {{.Namespace}}
-  labels:
-    app: {{.AppName}}
+{{- template "Metadata" .}}
 spec:
   selector:
     matchLabels:
       app: {{.AppName}}
+    {{- if .Intercept}}
+      reversepf.io/session: {{quote .Session}}
+    {{- end}}
   replicas: 1
   template:
     metadata:
       labels:
         app: {{.AppName}}
+        reversepf.io/session: {{quote .Session}}
+      annotations:
+        checksum/token: "{{.TokenChecksum}}"
+      {{- if .MetricsPort}}
+        prometheus.io/scrape: "true"
+        prometheus.io/port: "{{.MetricsPort}}"
+        prometheus.io/path: /metrics
+      {{- end}}
     spec:
+      {{- if .SelfDestruct}}
+      serviceAccountName: {{.ResourceName}}
+      {{- end}}
       containers:
         - name: {{.AppName}}
           image: v4run/{{.AppName}}:{{.Version}}
@@ -71,15 +252,126 @@ spec:
             - "remote"
             - "-c"
             - "{{.ControlServerPort}}"
-            - "-p"
-            - "{{.PortalPort}}"
+          {{- range .Mappings}}
             - "-s"
-            - "{{.ServicePort}}"
+            - "{{.ServicePortSpec}}"
+          {{- end}}
+            - "--grace-period"
+            - "{{.GracePeriod}}"
+            - "--max-pending"
+            - "{{.MaxPending}}"
+            - "--on-unavailable"
+            - {{quote .OnUnavailable}}
+          {{- range .Upstreams}}
+            - "--upstream"
+            - {{quote .}}
+          {{- end}}
+          {{- if .RouteHeader}}
+            - "--route-header"
+            - {{quote .RouteHeader}}
+          {{- end}}
+          {{- if and .Mirror (ne .Mirror "off")}}
+            - "--mirror"
+            - {{quote .Mirror}}
+          {{- end}}
+          {{- if .ExposeControl}}
+            - "--expose-control-server"
+          {{- end}}
+          {{- if .AcceptProxyProtocol}}
+            - "--accept-proxy-protocol"
+          {{- end}}
+          {{- if .MetricsPort}}
+            - "--metrics-port"
+            - "{{.MetricsPort}}"
+          {{- end}}
+            - "--health-port"
+            - "{{.HealthPort}}"
+          {{- if .ReadyRequiresClient}}
+            - "--ready-requires-client"
+          {{- end}}
+          {{- if .IdleTimeout}}
+            - "--idle-timeout"
+            - "{{.IdleTimeout}}"
+          {{- end}}
+          {{- if .SelfDestruct}}
+            - "--self-destruct"
+          {{- if .Intercept}}
+            - "--intercept"
+            - {{quote .Intercept}}
+            - "--session"
+            - {{quote .Session}}
+          {{- end}}
+          {{- end}}
+          {{- if .TLS}}
+            - "--tls-cert"
+            - "/etc/{{.AppName}}/tls/tls.crt"
+            - "--tls-key"
+            - "/etc/{{.AppName}}/tls/tls.key"
+            - "--tls-ca"
+            - "/etc/{{.AppName}}/tls/ca.crt"
+          {{- end}}
+          ports:
+            - name: health
+              containerPort: {{.HealthPort}}
+              protocol: TCP
+          {{- range .ContainerPorts}}
+            - name: {{.Name}}
+              containerPort: {{.Port}}
+              protocol: {{.Protocol}}
+          {{- end}}
+          {{- if .MetricsPort}}
+            - name: metrics
+              containerPort: {{.MetricsPort}}
+              protocol: TCP
+          {{- end}}
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: health
+            periodSeconds: 2
+            failureThreshold: 1
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: health
+            periodSeconds: 10
+            failureThreshold: 3
+          {{- if .TLS}}
+          volumeMounts:
+            - name: tls
+              mountPath: /etc/{{.AppName}}/tls
+              readOnly: true
+          {{- end}}
+          env:
+            - name: REVERSEPF_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{.ResourceName}}
+                  key: token
+          {{- if .SelfDestruct}}
+            - name: POD_NAMESPACE
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.namespace
+          {{- end}}
           resources:
             requests:
               cpu: 100m
               memory: 100Mi
       restartPolicy: Always
+      {{- if .TLS}}
+      volumes:
+        - name: tls
+          secret:
+            secretName: {{.ResourceName}}
+            items:
+              - key: tls.crt
+                path: tls.crt
+              - key: tls.key
+                path: tls.key
+              - key: ca.crt
+                path: ca.crt
+      {{- end}}
 `
 
 const service = `
@@ -88,21 +380,159 @@ kind: Service
 metadata:
   name: {{.AppName}}
   namespace: {{.Namespace}}
+{{- template "Metadata" .}}
 spec:
   selector:
     app: {{.AppName}}
   ports:
+  {{- if .ExposeControl}}
     - port: {{.ControlServerPort}}
       name: control-server
       protocol: TCP
-    - port: {{.PortalPort}}
-      name: portal-port
-      protocol: TCP
+  {{- end}}
+  {{- range .Mappings}}
     - port: {{.ServicePort}}
-      name: service
-      protocol: TCP
+      name: {{.PortName}}
+      protocol: {{.KubeProtocol}}
+  {{- end}}
 `
 
+const originalService = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.OriginalServiceName}}
+  namespace: {{.Namespace}}
+{{- template "Metadata" .}}
+spec:
+  selector:
+  {{- range $key, $value := .OriginalSelector}}
+    {{quote $key}}: {{quote $value}}
+  {{- end}}
+  ports:
+  {{- range .OriginalPorts}}
+    - port: {{.Port}}
+      targetPort: {{.TargetPort}}
+      protocol: {{.Protocol}}
+    {{- if .Name}}
+      name: {{.Name}}
+    {{- end}}
+  {{- end}}
+`
+
+const secret = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.ResourceName}}
+  namespace: {{.Namespace}}
+{{- template "Metadata" .}}
+type: Opaque
+stringData:
+  token: "{{.Token}}"
+{{- if .TLS}}
+data:
+  tls.crt: {{base64 .TLS.ServerCert}}
+  tls.key: {{base64 .TLS.ServerKey}}
+  ca.crt: {{base64 .TLS.CA}}
+{{- end}}
+`
+
+// serviceAccount, clusterRole and clusterRoleBinding let the remote component delete its namespace, and nothing
+// else. The cluster role and binding are owned by the namespace, so they are collected once it is gone.
+// While intercepting a service, the role and roleBinding are used instead.
+const serviceAccount = `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{.ResourceName}}
+  namespace: {{.Namespace}}
+{{- template "Metadata" .}}
+`
+
+const clusterRole = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{.Namespace}}
+{{- template "Metadata" .}}
+{{- template "NamespaceOwner" .}}
+rules:
+  - apiGroups: [""]
+    resources: ["namespaces"]
+    resourceNames: ["{{.Namespace}}"]
+    verbs: ["delete"]
+`
+
+const clusterRoleBinding = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{.Namespace}}
+{{- template "Metadata" .}}
+{{- template "NamespaceOwner" .}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{.Namespace}}
+subjects:
+  - kind: ServiceAccount
+    name: {{.ResourceName}}
+    namespace: {{.Namespace}}
+`
+
+// role lets the remote component restore the intercepted service and delete the resources of its session. The
+// role and binding are owned by the service account, which is deleted last, so they are collected along with it.
+const role = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.ResourceName}}
+  namespace: {{.Namespace}}
+{{- template "Metadata" .}}
+{{- template "ServiceAccountOwner" .}}
+rules:
+  - apiGroups: [""]
+    resources: ["services"]
+    resourceNames: [{{quote .Intercept}}]
+    verbs: ["get", "patch"]
+  - apiGroups: [""]
+    resources: ["services"]
+    resourceNames: ["{{.OriginalServiceName}}"]
+    verbs: ["delete"]
+  - apiGroups: [""]
+    resources: ["secrets", "serviceaccounts"]
+    resourceNames: ["{{.ResourceName}}"]
+    verbs: ["delete"]
+  - apiGroups: ["apps"]
+    resources: ["deployments"]
+    resourceNames: ["{{.ResourceName}}"]
+    verbs: ["delete"]
+`
+
+const roleBinding = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.ResourceName}}
+  namespace: {{.Namespace}}
+{{- template "Metadata" .}}
+{{- template "ServiceAccountOwner" .}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.ResourceName}}
+subjects:
+  - kind: ServiceAccount
+    name: {{.ResourceName}}
+    namespace: {{.Namespace}}
+`
+
+// RenderDeployment returns the manifest of the deployment of the remote component for the config.
+func RenderDeployment(config Config) (string, error) {
+	return executeTemplate(Deployment, config)
+}
+
 func executeTemplate(templateName string, config Config) (string, error) {
 	var buf bytes.Buffer
 	if err := tmplt.ExecuteTemplate(&buf, templateName, config); err != nil {
@@ -0,0 +1,71 @@
+package k8s
+
+import (
+	"slices"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+// renderArgs renders the deployment of the config and returns the args of the remote container.
+func renderArgs(t *testing.T, config Config) []string {
+	t.Helper()
+	manifest, err := executeTemplate(Deployment, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj unstructured.Unstructured
+	if _, _, err := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode([]byte(manifest), nil, &obj); err != nil {
+		t.Fatalf("decoding deployment: %v\n%s", err, manifest)
+	}
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 1 {
+		t.Fatalf("deployment has %d containers, want 1", len(containers))
+	}
+	args, _, _ := unstructured.NestedStringSlice(containers[0].(map[string]interface{}), "args")
+	return args
+}
+
+func TestDeploymentQuotesArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		flag   string
+		want   string
+	}{
+		{
+			name:   "route header with a quote",
+			config: Config{RouteHeader: `x-dev-user=al"ice`},
+			flag:   "--route-header",
+			want:   `x-dev-user=al"ice`,
+		},
+		{
+			name:   "route header with a backslash and a newline",
+			config: Config{RouteHeader: "x-dev-user=a\\\"\n- injected"},
+			flag:   "--route-header",
+			want:   "x-dev-user=a\\\"\n- injected",
+		},
+		{
+			name:   "upstream with a quote",
+			config: Config{Upstreams: []string{`80=web".team-a:80`}},
+			flag:   "--upstream",
+			want:   `80=web".team-a:80`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.AppName, config.Version, config.Namespace = "reversepf", "v1", "reversepf-test"
+			config.ControlServerPort, config.HealthPort = "9000", "8099"
+			args := renderArgs(t, config)
+			i := slices.Index(args, tt.flag)
+			if i < 0 || i+1 == len(args) {
+				t.Fatalf("args = %q, want %s", args, tt.flag)
+			}
+			if args[i+1] != tt.want {
+				t.Errorf("%s = %q, want %q", tt.flag, args[i+1], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var (
+	podRes   = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	eventRes = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "events"}
+)
+
+// fatalWaitingReasons are the reasons for which a waiting container never starts without a change to the pod
+var fatalWaitingReasons = []string{"InvalidImageName", "ErrImageNeverPull", "CreateContainerConfigError"}
+
+// podProblems reports every problem keeping the pod from becoming ready once, and remembers the last one.
+type podProblems struct {
+	lock     sync.Mutex
+	reported map[string]bool
+	last     string
+}
+
+func (p *podProblems) report(problem string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.last = problem
+	if p.reported[problem] {
+		return
+	}
+	p.reported[problem] = true
+	log.Warn("Remote pod is not ready", "problem", problem)
+}
+
+func (p *podProblems) lastProblem() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.last
+}
+
+// annotationTokenChecksum is set on the pod template to the checksum of the token of the run.
+const annotationTokenChecksum = "checksum/token"
+
+func (d *Deployer) podSelector() string {
+	return fmt.Sprintf("app=%s,%s=%s", d.k8sConfig.AppName, LabelSession, d.k8sConfig.Session)
+}
+
+// waitForPod watches the pods of this run until one of them is ready and returns its name. Problems
+// keeping the pod from becoming ready, and warning events of the namespace, are reported as they show up.
+// The pods of an earlier run of the session stay ready until the new one is, and hold the token of that run,
+// so only the pods with the token checksum of this run are considered.
+// An error is returned if the pod fails in a way it cannot recover from, or is not ready within ReadyTimeout.
+func (d *Deployer) waitForPod(ctx context.Context) (string, error) {
+	log.Info("Waiting for pod to be ready")
+	timeout := d.k8sConfig.ReadyTimeout
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	problems := &podProblems{reported: make(map[string]bool)}
+	d.spawn(func() { d.reportEvents(waitCtx, problems) })
+	pods := d.client.Resource(podRes).Namespace(d.k8sConfig.Namespace)
+	for {
+		list, err := pods.List(waitCtx, metav1.ListOptions{LabelSelector: d.podSelector()})
+		if err == nil {
+			for i := range list.Items {
+				if ready, err := d.checkPod(&list.Items[i], problems); ready || err != nil {
+					return list.Items[i].GetName(), err
+				}
+			}
+			var w watch.Interface
+			w, err = pods.Watch(waitCtx, metav1.ListOptions{LabelSelector: d.podSelector(), ResourceVersion: list.GetResourceVersion()})
+			if err == nil {
+				name, ready, err := d.watchPods(waitCtx, w, problems)
+				if ready || err != nil {
+					return name, err
+				}
+			}
+		}
+		if waitCtx.Err() != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if last := problems.lastProblem(); last != "" {
+				return "", fmt.Errorf("pod not ready after %s: %s", timeout, last)
+			}
+			return "", fmt.Errorf("pod not ready after %s", timeout)
+		}
+		if err != nil {
+			log.Warn("Error watching pods. Retrying", "err", err)
+		}
+		select {
+		case <-waitCtx.Done():
+		case <-time.After(time.Second * 2):
+		}
+	}
+}
+
+// watchPods checks every pod update until a pod is ready or fails, the watch ends, or the context is done.
+func (d *Deployer) watchPods(ctx context.Context, w watch.Interface, problems *podProblems) (string, bool, error) {
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return "", false, nil
+			}
+			pod, ok := event.Object.(*unstructured.Unstructured)
+			if !ok || event.Type == watch.Deleted {
+				continue
+			}
+			if ready, err := d.checkPod(pod, problems); ready || err != nil {
+				return pod.GetName(), ready, err
+			}
+		}
+	}
+}
+
+// checkPod reports whether the pod is a ready pod of this run. The problems of a pod which is not ready are reported, and an
+// error is returned if the pod can never become ready.
+func (d *Deployer) checkPod(pod *unstructured.Unstructured, problems *podProblems) (bool, error) {
+	if pod.GetAnnotations()[annotationTokenChecksum] != d.k8sConfig.TokenChecksum() {
+		return false, nil
+	}
+	if podReady(*pod, d.k8sConfig.ReadyRequiresClient) {
+		log.Info("Pod is Ready", "name", pod.GetName())
+		return true, nil
+	}
+	if pod.GetDeletionTimestamp() != nil {
+		return false, nil
+	}
+	if phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase"); phase == "Failed" || phase == "Succeeded" {
+		reason, _, _ := unstructured.NestedString(pod.Object, "status", "reason")
+		message, _, _ := unstructured.NestedString(pod.Object, "status", "message")
+		return false, fmt.Errorf("pod %s %s: %s", pod.GetName(), strings.ToLower(phase), describe(reason, message))
+	}
+	conditions, _, _ := unstructured.NestedSlice(pod.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != "PodScheduled" || condition["status"] != "False" {
+			continue
+		}
+		reason, _ := condition["reason"].(string)
+		message, _ := condition["message"].(string)
+		problems.report(describe(reason, message))
+	}
+	statuses, _, _ := unstructured.NestedSlice(pod.Object, "status", "containerStatuses")
+	for _, s := range statuses {
+		status, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		reason, _, _ := unstructured.NestedString(status, "state", "waiting", "reason")
+		message, _, _ := unstructured.NestedString(status, "state", "waiting", "message")
+		if reason == "" || reason == "ContainerCreating" || reason == "PodInitializing" {
+			continue
+		}
+		problem := describe(reason, message)
+		if reason == "CrashLoopBackOff" {
+			exitCode, found, _ := unstructured.NestedInt64(status, "lastState", "terminated", "exitCode")
+			if found {
+				restarts, _, _ := unstructured.NestedInt64(status, "restartCount")
+				problem = fmt.Sprintf("%s: container exited with code %d, restarted %d times. Check the remote logs", reason, exitCode, restarts)
+			}
+		}
+		if isFatalWaitingReason(reason, message) {
+			return false, errors.New(problem)
+		}
+		problems.report(problem)
+	}
+	return false, nil
+}
+
+func isFatalWaitingReason(reason, message string) bool {
+	for _, r := range fatalWaitingReasons {
+		if r == reason {
+			return true
+		}
+	}
+	// a missing image does not show up by retrying
+	return (reason == "ErrImagePull" || reason == "ImagePullBackOff") &&
+		(strings.Contains(message, "not found") || strings.Contains(message, "manifest unknown"))
+}
+
+// reportEvents reports the warning events of the namespace which are about the resources of this session,
+// like quota denials of the replica set or failed scheduling of the pod.
+func (d *Deployer) reportEvents(ctx context.Context, problems *podProblems) {
+	events := d.client.Resource(eventRes).Namespace(d.k8sConfig.Namespace)
+	list, err := events.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Debug("Unable to list events", "err", err)
+		return
+	}
+	for i := range list.Items {
+		if d.relevantEvent(&list.Items[i]) {
+			reportEvent(&list.Items[i], problems)
+		}
+	}
+	w, err := events.Watch(ctx, metav1.ListOptions{ResourceVersion: list.GetResourceVersion()})
+	if err != nil {
+		log.Debug("Unable to watch events", "err", err)
+		return
+	}
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			e, ok := event.Object.(*unstructured.Unstructured)
+			if ok && event.Type != watch.Deleted && d.relevantEvent(e) {
+				reportEvent(e, problems)
+			}
+		}
+	}
+}
+
+// relevantEvent reports whether the event is a recent warning about a resource of this session. All the
+// resources of a session are named after the resource name.
+func (d *Deployer) relevantEvent(event *unstructured.Unstructured) bool {
+	if typ, _, _ := unstructured.NestedString(event.Object, "type"); typ != "Warning" {
+		return false
+	}
+	kind, _, _ := unstructured.NestedString(event.Object, "involvedObject", "kind")
+	name, _, _ := unstructured.NestedString(event.Object, "involvedObject", "name")
+	if !d.ownsResource(kind, name) {
+		return false
+	}
+	last, _, _ := unstructured.NestedString(event.Object, "lastTimestamp")
+	if last == "" {
+		last, _, _ = unstructured.NestedString(event.Object, "eventTime")
+	}
+	at, err := time.Parse(time.RFC3339, last)
+	return err != nil || !at.Before(d.deployedAt.Truncate(time.Second))
+}
+
+// ownsResource reports whether the resource of the kind is named after the resource name of this session. The
+// replica sets of the deployment add the hash of the pod template to its name, and their pods a random suffix,
+// so a session whose name starts with the name of this session is told apart by the number of parts.
+func (d *Deployer) ownsResource(kind, name string) bool {
+	resourceName := d.k8sConfig.ResourceName()
+	if name == resourceName {
+		return true
+	}
+	rest, ok := strings.CutPrefix(name, resourceName+"-")
+	if !ok {
+		return false
+	}
+	switch kind {
+	case "ReplicaSet":
+		return !strings.Contains(rest, "-")
+	case "Pod":
+		return strings.Count(rest, "-") == 1
+	default:
+		return false
+	}
+}
+
+func reportEvent(event *unstructured.Unstructured, problems *podProblems) {
+	kind, _, _ := unstructured.NestedString(event.Object, "involvedObject", "kind")
+	name, _, _ := unstructured.NestedString(event.Object, "involvedObject", "name")
+	reason, _, _ := unstructured.NestedString(event.Object, "reason")
+	message, _, _ := unstructured.NestedString(event.Object, "message")
+	problems.report(fmt.Sprintf("%s %s: %s", kind, name, describe(reason, message)))
+}
+
+func describe(reason, message string) string {
+	if message == "" {
+		return reason
+	}
+	return reason + ": " + message
+}
+
+// podReady reports whether the Ready condition of the pod is true. A pod which is ready only with a local
+// component connected is never ready before port forwarding, so a running pod is enough in that case.
+func podReady(pod unstructured.Unstructured, readyRequiresClient bool) bool {
+	if pod.GetDeletionTimestamp() != nil {
+		return false
+	}
+	if readyRequiresClient {
+		phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+		return phase == "Running"
+	}
+	conditions, _, _ := unstructured.NestedSlice(pod.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Ready" {
+			return condition["status"] == "True"
+		}
+	}
+	return false
+}
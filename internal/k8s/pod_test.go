@@ -0,0 +1,306 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func testDeployer(readyTimeout time.Duration, objects ...runtime.Object) *Deployer {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		podRes:   "PodList",
+		eventRes: "EventList",
+	}, objects...)
+	return &Deployer{
+		client: client,
+		k8sConfig: Config{
+			AppName:      "reversepf",
+			Namespace:    "reversepf-test",
+			Session:      "test",
+			Token:        testToken,
+			ReadyTimeout: readyTimeout,
+		},
+	}
+}
+
+const testToken = "test-token"
+
+// testPod returns a pod of the current run of the test session with the status.
+func testPod(status map[string]interface{}) *unstructured.Unstructured {
+	return runPod("reversepf-1", testToken, status)
+}
+
+// runPod returns a pod of the test session created by the run with the token.
+func runPod(name, token string, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "reversepf-test",
+			"labels": map[string]interface{}{
+				"app":        "reversepf",
+				LabelSession: "test",
+			},
+			"annotations": map[string]interface{}{
+				annotationTokenChecksum: Config{Token: token}.TokenChecksum(),
+			},
+		},
+		"status": status,
+	}}
+}
+
+func waiting(reason, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"phase": "Pending",
+		"containerStatuses": []interface{}{
+			map[string]interface{}{
+				"name":  "reversepf",
+				"state": map[string]interface{}{"waiting": map[string]interface{}{"reason": reason, "message": message}},
+			},
+		},
+	}
+}
+
+var (
+	readyStatus = map[string]interface{}{
+		"phase": "Running",
+		"conditions": []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "True"},
+		},
+	}
+	unschedulableStatus = map[string]interface{}{
+		"phase": "Pending",
+		"conditions": []interface{}{
+			map[string]interface{}{
+				"type":    "PodScheduled",
+				"status":  "False",
+				"reason":  "Unschedulable",
+				"message": "0/3 nodes are available: 3 Insufficient memory.",
+			},
+		},
+	}
+	crashLoopStatus = map[string]interface{}{
+		"phase": "Running",
+		"containerStatuses": []interface{}{
+			map[string]interface{}{
+				"name":         "reversepf",
+				"restartCount": int64(4),
+				"state": map[string]interface{}{
+					"waiting": map[string]interface{}{"reason": "CrashLoopBackOff", "message": "back-off 1m20s restarting failed container"},
+				},
+				"lastState": map[string]interface{}{
+					"terminated": map[string]interface{}{"exitCode": int64(2)},
+				},
+			},
+		},
+	}
+)
+
+func TestCheckPod(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  map[string]interface{}
+		ready   bool
+		fatal   string
+		problem string
+	}{
+		{name: "ready", status: readyStatus, ready: true},
+		{name: "creating", status: waiting("ContainerCreating", "")},
+		{
+			name:    "image pull back off",
+			status:  waiting("ImagePullBackOff", `Back-off pulling image "v4run/reversepf:v1": toomanyrequests`),
+			problem: `ImagePullBackOff: Back-off pulling image "v4run/reversepf:v1": toomanyrequests`,
+		},
+		{
+			name:   "missing image",
+			status: waiting("ImagePullBackOff", `Back-off pulling image "v4run/reversepf:v0": manifest unknown`),
+			fatal:  `ImagePullBackOff: Back-off pulling image "v4run/reversepf:v0": manifest unknown`,
+		},
+		{
+			name:   "invalid image name",
+			status: waiting("InvalidImageName", "couldn't parse image reference"),
+			fatal:  "InvalidImageName: couldn't parse image reference",
+		},
+		{
+			name:    "crash loop back off",
+			status:  crashLoopStatus,
+			problem: "CrashLoopBackOff: container exited with code 2, restarted 4 times. Check the remote logs",
+		},
+		{
+			name:    "unschedulable",
+			status:  unschedulableStatus,
+			problem: "Unschedulable: 0/3 nodes are available: 3 Insufficient memory.",
+		},
+		{
+			name:   "failed",
+			status: map[string]interface{}{"phase": "Failed", "reason": "Evicted", "message": "The node was low on memory."},
+			fatal:  "pod reversepf-1 failed: Evicted: The node was low on memory.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDeployer(time.Second)
+			problems := &podProblems{reported: make(map[string]bool)}
+			ready, err := d.checkPod(testPod(tt.status), problems)
+			if ready != tt.ready {
+				t.Errorf("ready = %v, want %v", ready, tt.ready)
+			}
+			if tt.fatal == "" && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			if tt.fatal != "" && (err == nil || err.Error() != tt.fatal) {
+				t.Errorf("err = %v, want %q", err, tt.fatal)
+			}
+			if last := problems.lastProblem(); last != tt.problem {
+				t.Errorf("problem = %q, want %q", last, tt.problem)
+			}
+		})
+	}
+}
+
+func TestWaitForPodReady(t *testing.T) {
+	d := testDeployer(5*time.Second, testPod(unschedulableStatus))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// the pod is updated until the wait is over, as the update is lost if sent before the watch starts
+		pods := d.client.Resource(podRes).Namespace(d.k8sConfig.Namespace)
+		for ctx.Err() == nil {
+			pods.Update(ctx, testPod(readyStatus), metav1.UpdateOptions{})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	name, err := d.waitForPod(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "reversepf-1" {
+		t.Errorf("name = %q, want %q", name, "reversepf-1")
+	}
+}
+
+func TestWaitForPodSkipsEarlierRun(t *testing.T) {
+	// the pod of the earlier run stays ready during the rollout of the pod of this run
+	old := runPod("reversepf-old", "old-token", readyStatus)
+	d := testDeployer(300*time.Millisecond, old, runPod("reversepf-new", testToken, waiting("ContainerCreating", "")))
+	if name, err := d.waitForPod(context.Background()); err == nil {
+		t.Fatalf("name = %q, want the wait to time out", name)
+	}
+
+	d = testDeployer(5*time.Second, old, runPod("reversepf-new", testToken, waiting("ContainerCreating", "")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		pods := d.client.Resource(podRes).Namespace(d.k8sConfig.Namespace)
+		for ctx.Err() == nil {
+			pods.Update(ctx, runPod("reversepf-new", testToken, readyStatus), metav1.UpdateOptions{})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	name, err := d.waitForPod(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "reversepf-new" {
+		t.Errorf("name = %q, want %q", name, "reversepf-new")
+	}
+}
+
+func TestWaitForPodFatal(t *testing.T) {
+	d := testDeployer(5*time.Second, testPod(waiting("ErrImagePull", "rpc error: code = NotFound desc = not found")))
+	start := time.Now()
+	_, err := d.waitForPod(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "ErrImagePull") {
+		t.Errorf("err = %v, want the image pull error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s, want without waiting for the timeout", elapsed)
+	}
+}
+
+func TestWaitForPodTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		status map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "unschedulable",
+			status: unschedulableStatus,
+			want:   "pod not ready after 300ms: Unschedulable: 0/3 nodes are available: 3 Insufficient memory.",
+		},
+		{
+			name:   "crash loop back off",
+			status: crashLoopStatus,
+			want:   "pod not ready after 300ms: CrashLoopBackOff: container exited with code 2, restarted 4 times. Check the remote logs",
+		},
+		{
+			name:   "image pull back off",
+			status: waiting("ImagePullBackOff", "toomanyrequests"),
+			want:   "pod not ready after 300ms: ImagePullBackOff: toomanyrequests",
+		},
+		{
+			name:   "no problem",
+			status: waiting("ContainerCreating", ""),
+			want:   "pod not ready after 300ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDeployer(300*time.Millisecond, testPod(tt.status))
+			_, err := d.waitForPod(context.Background())
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForPodCancelled(t *testing.T) {
+	d := testDeployer(5*time.Second, testPod(unschedulableStatus))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := d.waitForPod(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestOwnsResource(t *testing.T) {
+	tests := []struct {
+		intercept string
+		kind      string
+		name      string
+		want      bool
+	}{
+		{kind: "Deployment", name: "reversepf", want: true},
+		{kind: "Pod", name: "reversepf-5d8f7c9b4-x2k7p", want: true},
+		{intercept: "web", kind: "Deployment", name: "reversepf-test", want: true},
+		{intercept: "web", kind: "ReplicaSet", name: "reversepf-test-5d8f7c9b4", want: true},
+		{intercept: "web", kind: "Pod", name: "reversepf-test-5d8f7c9b4-x2k7p", want: true},
+		// the resources of the session testing, which shares the prefix
+		{intercept: "web", kind: "Deployment", name: "reversepf-testing"},
+		{intercept: "web", kind: "Pod", name: "reversepf-testing-5d8f7c9b4-x2k7p"},
+		// the resources of the session test-2
+		{intercept: "web", kind: "Deployment", name: "reversepf-test-2"},
+		{intercept: "web", kind: "ReplicaSet", name: "reversepf-test-2-5d8f7c9b4"},
+		{intercept: "web", kind: "Pod", name: "reversepf-test-2-5d8f7c9b4-x2k7p"},
+		{intercept: "web", kind: "Service", name: "web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+"/"+tt.name, func(t *testing.T) {
+			d := testDeployer(time.Second)
+			d.k8sConfig.Intercept = tt.intercept
+			if got := d.ownsResource(tt.kind, tt.name); got != tt.want {
+				t.Errorf("ownsResource = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
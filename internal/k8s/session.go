@@ -0,0 +1,342 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/remote"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	LabelManagedBy         = "app.kubernetes.io/managed-by"
+	annotationOwner        = "reversepf.io/owner"
+	annotationHost         = "reversepf.io/host"
+	annotationCreatedAt    = "reversepf.io/created-at"
+	annotationTTL          = "reversepf.io/ttl"
+	annotationIntercept    = "reversepf.io/intercept"
+	annotationSelfDestruct = "reversepf.io/self-destruct"
+	// annotationRenewedAt is updated while the local component runs, so that only abandoned sessions expire
+	annotationRenewedAt = "reversepf.io/renewed-at"
+)
+
+// Session is a run of the k8s command found in the cluster. A session owns its namespace, unless it intercepts
+// a service, in which case it owns a deployment in the namespace of the service.
+type Session struct {
+	Name         string
+	Namespace    string
+	Intercept    string
+	Owner        string
+	Host         string
+	CreatedAt    time.Time
+	RenewedAt    time.Time
+	TTL          time.Duration
+	SelfDestruct bool
+}
+
+// LastSeen is the last time the local component of the session was known to be running.
+func (s Session) LastSeen() time.Time {
+	if s.RenewedAt.After(s.CreatedAt) {
+		return s.RenewedAt
+	}
+	return s.CreatedAt
+}
+
+// Expired reports whether the local component was last seen more than TTL ago. Sessions without a TTL never expire.
+func (s Session) Expired(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.LastSeen()) > s.TTL
+}
+
+func sessionFrom(obj unstructured.Unstructured) Session {
+	annotations := obj.GetAnnotations()
+	createdAt, _ := time.Parse(time.RFC3339, annotations[annotationCreatedAt])
+	renewedAt, _ := time.Parse(time.RFC3339, annotations[annotationRenewedAt])
+	ttl, _ := time.ParseDuration(annotations[annotationTTL])
+	selfDestruct, _ := strconv.ParseBool(annotations[annotationSelfDestruct])
+	return Session{
+		Name:         obj.GetLabels()[LabelSession],
+		Namespace:    obj.GetNamespace(),
+		Intercept:    annotations[annotationIntercept],
+		Owner:        annotations[annotationOwner],
+		Host:         annotations[annotationHost],
+		CreatedAt:    createdAt,
+		RenewedAt:    renewedAt,
+		TTL:          ttl,
+		SelfDestruct: selfDestruct,
+	}
+}
+
+// ListSessions returns the sessions across the cluster, found by the labels of their namespaces and, for the
+// sessions intercepting a service, of their deployments.
+func (d *Deployer) ListSessions(ctx context.Context) ([]Session, error) {
+	selector := metav1.ListOptions{LabelSelector: LabelManagedBy + "=" + d.k8sConfig.AppName}
+	namespaces, err := d.client.Resource(namespaceRes).List(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, ns := range namespaces.Items {
+		session := sessionFrom(ns)
+		session.Namespace = ns.GetName()
+		sessions = append(sessions, session)
+	}
+	deployments, err := d.client.Resource(deploymentRes).List(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		if session := sessionFrom(deployment); session.Intercept != "" {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// DeleteSession deletes the resources of the session, restoring the service it intercepts.
+func (d *Deployer) DeleteSession(ctx context.Context, session Session) {
+	other := *d
+	other.k8sConfig.Namespace = session.Namespace
+	other.k8sConfig.Session = session.Name
+	other.k8sConfig.Intercept = session.Intercept
+	other.k8sConfig.SelfDestruct = session.SelfDestruct
+	other.deleteResources(ctx)
+}
+
+// sessionObject returns the resource carrying the annotations of the session, or nil if the session does not exist.
+func (d *Deployer) sessionObject(ctx context.Context) (*unstructured.Unstructured, error) {
+	var (
+		obj *unstructured.Unstructured
+		err error
+	)
+	if d.k8sConfig.Intercept != "" {
+		obj, err = d.client.Resource(deploymentRes).Namespace(d.k8sConfig.Namespace).Get(ctx, d.k8sConfig.ResourceName(), metav1.GetOptions{})
+	} else {
+		obj, err = d.client.Resource(namespaceRes).Get(ctx, d.k8sConfig.Namespace, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return obj, err
+}
+
+// checkOwnership refuses to replace a live session of the same name started by another user or on another
+// machine, unless Takeover is set. Sessions of the same owner are replaced, so that a run can be restarted.
+func (d *Deployer) checkOwnership(ctx context.Context) error {
+	obj, err := d.sessionObject(ctx)
+	if err != nil || obj == nil {
+		return err
+	}
+	existing := sessionFrom(*obj)
+	// sessions created before ownership was recorded have no owner
+	if existing.Owner == "" || (existing.Owner == d.k8sConfig.Owner && existing.Host == d.k8sConfig.Host) {
+		return nil
+	}
+	if existing.Expired(time.Now()) {
+		log.Warn("Replacing expired session of another owner", "name", d.k8sConfig.Session, "owner", existing.Owner, "host", existing.Host)
+		return nil
+	}
+	if d.k8sConfig.Takeover {
+		log.Warn("Taking over session of another owner", "name", d.k8sConfig.Session, "owner", existing.Owner, "host", existing.Host)
+		return nil
+	}
+	return fmt.Errorf(
+		"session %s is owned by %s on %s, last seen %s ago. Use another name, or --takeover to replace it",
+		d.k8sConfig.Session, existing.Owner, existing.Host, time.Since(existing.LastSeen()).Round(time.Second),
+	)
+}
+
+// replaced reports whether the session was replaced by another run since this run deployed it, in which case
+// its resources belong to the other run.
+func (d *Deployer) replaced(ctx context.Context) bool {
+	obj, err := d.sessionObject(ctx)
+	if err != nil || obj == nil {
+		return false
+	}
+	return obj.GetAnnotations()[annotationCreatedAt] != d.k8sConfig.Created()
+}
+
+// renewSession records that the local component is running, every third of the TTL, until the context is done.
+func (d *Deployer) renewSession(ctx context.Context) {
+	if d.k8sConfig.TTL <= 0 {
+		return
+	}
+	var res dynamic.ResourceInterface = d.client.Resource(namespaceRes)
+	name := d.k8sConfig.Namespace
+	if d.k8sConfig.Intercept != "" {
+		res, name = d.client.Resource(deploymentRes).Namespace(d.k8sConfig.Namespace), d.k8sConfig.ResourceName()
+	}
+	ticker := time.NewTicker(d.k8sConfig.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{
+					annotationRenewedAt: time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		})
+		if err != nil {
+			continue
+		}
+		if _, err := res.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{
+			FieldManager: d.k8sConfig.AppName + "-k8s",
+		}); err != nil && ctx.Err() == nil {
+			log.Warn("Unable to renew session. It may be collected by gc", "err", err)
+		}
+	}
+}
+
+// SelfDestruct deletes the namespace of the remote component. The cluster role and binding allowing it are owned
+// by the namespace, so they are collected along with it. A remote component intercepting a service restores the
+// service and deletes the resources of its session instead. It runs in the remote component, with the credentials
+// of the service account of the pod.
+func SelfDestruct(ctx context.Context, config Config) error {
+	if config.Namespace == "" {
+		return errors.New("namespace of the pod is unknown")
+	}
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	return selfDestruct(ctx, client, config)
+}
+
+func selfDestruct(ctx context.Context, client dynamic.Interface, config Config) error {
+	if config.Intercept != "" {
+		d := Deployer{client: client, k8sConfig: config}
+		d.cleanupIntercept(ctx)
+		return nil
+	}
+	if err := client.Resource(namespaceRes).Delete(ctx, config.Namespace, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("error deleting namespace: %w", err)
+	}
+	return nil
+}
+
+// SessionStatus is the state of a session in the cluster.
+type SessionStatus struct {
+	Session
+	// Addrs are the addresses of the service through which the session is reached
+	Addrs []string
+	Pod   string
+	// Remote is the status reported by the remote component, if it could be reached
+	Remote    *remote.Status
+	RemoteErr error
+}
+
+// Status returns the state of the session. The remote component is reached through the api server proxy.
+func (d *Deployer) Status(ctx context.Context, session Session) SessionStatus {
+	status := SessionStatus{Session: session}
+	service, appName := session.Intercept, d.k8sConfig.AppName
+	if service == "" {
+		service = appName
+	}
+	if svc, err := d.client.Resource(serviceRes).Namespace(session.Namespace).Get(ctx, service, metav1.GetOptions{}); err == nil {
+		ports, _, _ := unstructured.NestedSlice(svc.Object, "spec", "ports")
+		for _, p := range ports {
+			port, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			number, _, _ := unstructured.NestedInt64(port, "port")
+			protocol, _, _ := unstructured.NestedString(port, "protocol")
+			status.Addrs = append(status.Addrs, fmt.Sprintf("%s.%s:%d/%s", service, session.Namespace, number, strings.ToLower(protocol)))
+		}
+	}
+	other := *d
+	other.k8sConfig.Session = session.Name
+	pods, err := d.client.Resource(podRes).Namespace(session.Namespace).List(ctx, metav1.ListOptions{LabelSelector: other.podSelector()})
+	if err != nil {
+		status.RemoteErr = err
+		return status
+	}
+	var pod *unstructured.Unstructured
+	for i := range pods.Items {
+		if podReady(pods.Items[i], true) {
+			pod = &pods.Items[i]
+			break
+		}
+	}
+	if pod == nil {
+		status.RemoteErr = errors.New("no running pod")
+		return status
+	}
+	status.Pod = pod.GetName()
+	status.Remote, status.RemoteErr = d.remoteStatus(ctx, pod)
+	return status
+}
+
+// remoteStatus gets the status served on the health port of the pod.
+func (d *Deployer) remoteStatus(ctx context.Context, pod *unstructured.Unstructured) (*remote.Status, error) {
+	port := ""
+	containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ports, _, _ := unstructured.NestedSlice(container, "ports")
+		for _, p := range ports {
+			if p, ok := p.(map[string]interface{}); ok && p["name"] == "health" {
+				number, _, _ := unstructured.NestedInt64(p, "containerPort")
+				port = strconv.FormatInt(number, 10)
+			}
+		}
+	}
+	if port == "" {
+		return nil, errors.New("remote component does not serve its status")
+	}
+	httpClient, err := rest.HTTPClientFor(d.config)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(d.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "api", "v1", "namespaces", pod.GetNamespace(), "pods", pod.GetName()+":"+port, "proxy", "status")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var status remote.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// sessionAnnotations returns the annotations of a session of the owner, created and last renewed at the times.
+func sessionAnnotations(owner string, createdAt, renewedAt time.Time, ttl time.Duration) map[string]interface{} {
+	annotations := map[string]interface{}{
+		annotationCreatedAt: createdAt.UTC().Format(time.RFC3339),
+		annotationTTL:       ttl.String(),
+	}
+	if owner != "" {
+		annotations[annotationOwner] = owner
+		annotations[annotationHost] = owner + "-laptop"
+	}
+	if !renewedAt.IsZero() {
+		annotations[annotationRenewedAt] = renewedAt.UTC().Format(time.RFC3339)
+	}
+	return annotations
+}
+
+// sessionNamespace returns the namespace of the test session with the annotations.
+func sessionNamespace(annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":        "reversepf-test",
+			"labels":      map[string]interface{}{LabelManagedBy: "reversepf", LabelSession: "test"},
+			"annotations": annotations,
+		},
+	}}
+}
+
+// ownedDeployer returns a deployer of the test session run by alice.
+func ownedDeployer(objects ...runtime.Object) *Deployer {
+	d := testDeployer(time.Second, objects...)
+	d.k8sConfig.Owner, d.k8sConfig.Host = "alice", "alice-laptop"
+	return d
+}
+
+func TestCheckOwnership(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		annotations map[string]interface{}
+		takeover    bool
+		err         string
+	}{
+		{name: "no session"},
+		{name: "same owner", annotations: sessionAnnotations("alice", now, now, time.Hour)},
+		{name: "no owner recorded", annotations: sessionAnnotations("", now, now, time.Hour)},
+		{
+			name:        "live session of another owner",
+			annotations: sessionAnnotations("bob", now.Add(-2*time.Hour), now, time.Hour),
+			err:         "session test is owned by bob on bob-laptop",
+		},
+		{name: "expired session of another owner", annotations: sessionAnnotations("bob", now.Add(-3*time.Hour), now.Add(-2*time.Hour), time.Hour)},
+		{
+			name:        "session of another owner without ttl",
+			annotations: sessionAnnotations("bob", now.Add(-48*time.Hour), time.Time{}, 0),
+			err:         "session test is owned by bob on bob-laptop",
+		},
+		{name: "takeover", annotations: sessionAnnotations("bob", now, now, time.Hour), takeover: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tt.annotations != nil {
+				objects = append(objects, sessionNamespace(tt.annotations))
+			}
+			d := ownedDeployer(objects...)
+			d.k8sConfig.Takeover = tt.takeover
+			err := d.checkOwnership(context.Background())
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("checkOwnership = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkOwnership = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckOwnershipIntercept(t *testing.T) {
+	deployment := testObject("apps/v1", "Deployment", "reversepf-test")
+	deployment.SetAnnotations(map[string]string{
+		annotationOwner:     "bob",
+		annotationHost:      "bob-laptop",
+		annotationCreatedAt: time.Now().UTC().Format(time.RFC3339),
+		annotationTTL:       time.Hour.String(),
+	})
+	d := ownedDeployer(deployment)
+	d.k8sConfig.Intercept = "web"
+	// the session of an intercept is found by its deployment
+	if err := d.checkOwnership(context.Background()); err == nil {
+		t.Error("checkOwnership = nil, want the live session of bob refused")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	deployedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	tests := []struct {
+		name      string
+		createdAt time.Time
+		deleted   bool
+	}{
+		{name: "own session", createdAt: deployedAt, deleted: true},
+		{name: "taken over", createdAt: deployedAt.Add(30 * time.Second), deleted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := ownedDeployer(sessionNamespace(sessionAnnotations("bob", tt.createdAt, time.Time{}, time.Hour)))
+			d.deployedAt, d.k8sConfig.CreatedAt = deployedAt, deployedAt
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			d.Cleanup(ctx)
+			_, err := d.client.Resource(namespaceRes).Get(ctx, "reversepf-test", metav1.GetOptions{})
+			if deleted := apierrors.IsNotFound(err); deleted != tt.deleted {
+				t.Errorf("namespace deleted = %v (err %v), want %v", deleted, err, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestCleanupWithoutDeploy(t *testing.T) {
+	d := ownedDeployer(sessionNamespace(sessionAnnotations("alice", time.Now(), time.Time{}, time.Hour)))
+	d.Cleanup(context.Background())
+	if _, err := d.client.Resource(namespaceRes).Get(context.Background(), "reversepf-test", metav1.GetOptions{}); err != nil {
+		t.Errorf("namespace of a session this run never deployed: err = %v, want it left", err)
+	}
+}
+
+func TestRenewSession(t *testing.T) {
+	createdAt := time.Now().Add(-time.Hour)
+	d := ownedDeployer(sessionNamespace(sessionAnnotations("alice", createdAt, time.Time{}, time.Hour)))
+	d.k8sConfig.TTL = 30 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.renewSession(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ns, err := d.client.Resource(namespaceRes).Get(ctx, "reversepf-test", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session := sessionFrom(*ns); session.RenewedAt.After(createdAt) {
+			if session.Expired(time.Now()) {
+				t.Error("renewed session expired")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSelfDestructNamespace(t *testing.T) {
+	d := ownedDeployer(sessionNamespace(sessionAnnotations("alice", time.Now(), time.Time{}, time.Hour)))
+	ctx := context.Background()
+	if err := selfDestruct(ctx, d.client, Config{AppName: "reversepf", Namespace: "reversepf-test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.client.Resource(namespaceRes).Get(ctx, "reversepf-test", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("namespace: err = %v, want it deleted", err)
+	}
+	if err := SelfDestruct(ctx, Config{AppName: "reversepf"}); err == nil {
+		t.Error("SelfDestruct = nil without the namespace of the pod, want an error")
+	}
+}
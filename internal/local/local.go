@@ -2,34 +2,98 @@ package local
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/mux"
+	"github.com/v4run/reversepf/internal/proxy"
+	"github.com/v4run/reversepf/internal/proxyproto"
+	"github.com/v4run/reversepf/version"
+)
+
+const handshakeTimeout = time.Second * 10
+
+// dialTimeout is how long connecting to a local target may take. It is shorter than the default connect timeout
+// of the remote component, so that a failure is reported before the remote gives up on the connection.
+const dialTimeout = time.Second * 8
+
+var (
+	// ErrIncompatible is returned when the local and remote components speak different protocol versions.
+	ErrIncompatible = errors.New("local and remote components are incompatible")
+	// ErrUnauthorized is returned when the remote component rejects the token. Retrying cannot succeed.
+	ErrUnauthorized = errors.New("remote component rejected the token")
 )
 
 type Local struct {
 	controlServerPort string
-	portalPort        string
-	localServicePort  string
+	mappings          []mapping.Mapping
+	token             string
+	tlsConfig         *tls.Config
+	// proxyProtocol is the version of the PROXY protocol header sent to tcp targets. No header is sent if empty
+	proxyProtocol string
+	// spawn runs the handlers in new goroutines
+	spawn func(func())
+	// connections are the proxy connections in flight
+	connections *sync.WaitGroup
+	// draining is set once no new connections are accepted. drainLock makes sure that no connection is added
+	// once Drain waits for the connections
+	draining  *atomic.Bool
+	drainLock *sync.Mutex
 }
 
-func NewLocalComponent(localServicePort, portalPort, controlServerPort string) Local {
+func NewLocalComponent(mappings []mapping.Mapping, controlServerPort, token string, tlsConfig *tls.Config, proxyProtocol string, spawn func(func())) Local {
+	if spawn == nil {
+		log.Fatal("Error creating local component. `spawn` is nil")
+	}
 	return Local{
 		controlServerPort: controlServerPort,
-		portalPort:        portalPort,
-		localServicePort:  localServicePort,
+		mappings:          mappings,
+		token:             token,
+		tlsConfig:         tlsConfig,
+		proxyProtocol:     proxyProtocol,
+		spawn:             spawn,
+		connections:       new(sync.WaitGroup),
+		draining:          new(atomic.Bool),
+		drainLock:         new(sync.Mutex),
 	}
 }
 
-func (l Local) Start() {
-	l.establishControlServerConnection()
+// Start proxies the connections of the remote component. It only returns when the components are incompatible,
+// or when the remote component rejects the token.
+func (l Local) Start() error {
+	return l.establishControlServerConnection()
+}
+
+// Drain refuses new connections and waits for the connections in flight to finish, or for the context to be done.
+func (l Local) Drain(ctx context.Context) {
+	l.drainLock.Lock()
+	l.draining.Store(true)
+	l.drainLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		l.connections.Wait()
+		close(done)
+	}()
+	log.Info("Waiting for connections in flight to finish")
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Connections still in flight after drain timeout")
+	}
 }
 
-func (l Local) establishControlServerConnection() {
+func (l Local) establishControlServerConnection() error {
 	var (
 		err  error
 		conn net.Conn
@@ -37,61 +101,231 @@ func (l Local) establishControlServerConnection() {
 	log.Info("Establishing control server connection", "controlServerPort", l.controlServerPort)
 	for {
 		for {
-			conn, err = net.Dial("tcp", net.JoinHostPort("", l.controlServerPort))
+			conn, err = l.dialControlServer()
 			if err != nil {
-				log.Warn("Waiting for control server to start")
+				if !l.draining.Load() {
+					log.Warn("Waiting for control server to start")
+				}
 				time.Sleep(time.Second * 3)
 				continue
 			}
 			log.Info("Established connection to control server")
 			break
 		}
-		defer conn.Close()
-		reader := bufio.NewReader(conn)
+		session := mux.Client(conn)
+		reader := bufio.NewReader(session.Control())
+		features, err := l.handshake(session, reader)
+		if err != nil {
+			log.Error("Handshake with control server failed", "err", err)
+			session.Close()
+			if errors.Is(err, ErrIncompatible) || errors.Is(err, ErrUnauthorized) {
+				return err
+			}
+			time.Sleep(time.Second * 3)
+			continue
+		}
+		l.spawn(func() { l.handleControlMessages(reader) })
 		for {
-			command, err := commands.ReadCommand(reader)
+			stream, err := session.Accept()
 			if err != nil {
-				log.Error("Error getting/processing command from remote", "err", err)
-				if errors.Is(err, io.EOF) {
-					break
-				}
+				break
+			}
+			command, err := commands.ParseCommand(stream.Metadata())
+			if err != nil {
+				log.Error("Error processing stream from remote", "err", err)
+				stream.Close()
 				continue
 			}
-			log.Info("New command received from remote", "command", command)
+			log.Info("New stream received from remote", "command", command)
 			switch command.Type {
 			case commands.TypeInit:
-				go l.handleInitCommand()
+				ack := slices.Contains(features, commands.FeatureInitAck)
+				if !l.addConnection() {
+					if ack {
+						l.reportDialFailure(session, command.ID, "local component is shutting down")
+					}
+					stream.Close()
+					continue
+				}
+				l.spawn(func() {
+					defer l.connections.Done()
+					l.handleInitCommand(session, stream, command, ack)
+				})
 			default:
+				stream.Close()
 			}
 		}
+		session.Close()
 		log.Info("Client disconnected")
 	}
 }
 
-func (l Local) handleInitCommand() {
-	log.Info("Starting a new proxy connection", "portalPort", l.portalPort, "localPort", l.localServicePort)
-	portalConn, err := net.Dial("tcp", net.JoinHostPort("", l.portalPort))
+// addConnection adds a connection in flight, unless the component is draining.
+func (l Local) addConnection() bool {
+	l.drainLock.Lock()
+	defer l.drainLock.Unlock()
+	if l.draining.Load() {
+		return false
+	}
+	l.connections.Add(1)
+	return true
+}
+
+func (l Local) dialControlServer() (net.Conn, error) {
+	addr := net.JoinHostPort("", l.controlServerPort)
+	if l.tlsConfig != nil {
+		return tls.Dial("tcp", addr, l.tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// handshake exchanges hello commands with the control server and returns the features both sides support.
+func (l Local) handshake(session *mux.Session, reader *bufio.Reader) ([]string, error) {
+	control := session.Control()
+	if _, err := control.Write(commands.NewHelloCommand(commands.SupportedFeatures, l.token).Bytes()); err != nil {
+		return nil, err
+	}
+	control.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hello, err := commands.ReadCommand(reader)
 	if err != nil {
-		log.Error("Unable to connect to portal", "err", err)
+		return nil, fmt.Errorf("error reading hello: %w", err)
+	}
+	control.SetReadDeadline(time.Time{})
+	switch hello.Type {
+	case commands.TypeHello:
+	case commands.TypeError:
+		if hello.Reason == commands.ErrAuthenticationFailed.Error() {
+			return nil, ErrUnauthorized
+		}
+		return nil, errors.New(hello.Reason)
+	default:
+		return nil, fmt.Errorf("expected hello, received %s", hello)
+	}
+	if hello.Protocol != commands.ProtocolVersion {
+		log.Error(
+			"Local and remote components are incompatible. Please use the same version for both",
+			"localVersion", version.Version,
+			"localProtocol", commands.ProtocolVersion,
+			"remoteVersion", hello.Version,
+			"remoteProtocol", hello.Protocol,
+		)
+		return nil, ErrIncompatible
+	}
+	features := commands.CommonFeatures(commands.SupportedFeatures, hello.Features)
+	log.Info("Handshake with control server completed", "remoteVersion", hello.Version, "features", features)
+	return features, nil
+}
+
+func (l Local) handleControlMessages(reader *bufio.Reader) {
+	for {
+		command, err := commands.ReadCommand(reader)
+		if err != nil {
+			log.Error("Error getting/processing command from remote", "err", err)
+			if _, ok := err.(*json.SyntaxError); ok {
+				continue
+			}
+			return
+		}
+		if command.Type == commands.TypeError {
+			log.Error("Error received from remote", "reason", command.Reason)
+			continue
+		}
+		log.Info("New command received from remote", "command", command)
+	}
+}
+
+// mappingFor returns the mapping for the service port. Connections without a
+// service port are sent to the only mapping, if there is just one.
+func (l Local) mappingFor(servicePort, network string) (mapping.Mapping, bool) {
+	if servicePort == "" && len(l.mappings) == 1 {
+		return l.mappings[0], true
+	}
+	if network == "" {
+		network = mapping.ProtocolTCP
+	}
+	for _, m := range l.mappings {
+		if m.ServicePort == servicePort && m.Protocol == network {
+			return m, true
+		}
+	}
+	return mapping.Mapping{}, false
+}
+
+func (l Local) handleInitCommand(session *mux.Session, stream net.Conn, command commands.Command, ack bool) {
+	defer stream.Close()
+	m, ok := l.mappingFor(command.ServicePort, command.Network)
+	if !ok {
+		log.Error("No local port mapped to service port", "id", command.ID, "servicePort", command.ServicePort, "network", command.Network)
+		if ack {
+			l.reportDialFailure(session, command.ID, fmt.Sprintf("no local target mapped to service port %s/%s", command.ServicePort, command.Network))
+		}
 		return
 	}
-	defer portalConn.Close()
-	localConn, err := net.Dial("tcp", net.JoinHostPort("", l.localServicePort))
+	log.Info("Starting a new proxy connection", "id", command.ID, "mapping", m)
+	localConn, err := m.Dial(dialTimeout)
 	if err != nil {
-		log.Error("Unable to connect to local", "err", err)
+		log.Error("Unable to connect to local target", "id", command.ID, "target", m.TargetAddr, "err", err)
+		if ack {
+			l.reportDialFailure(session, command.ID, err.Error())
+		}
 		return
 	}
 	defer localConn.Close()
-	go func() {
-		defer localConn.Close()
-		if _, err := io.Copy(localConn, portalConn); err != nil {
-			log.Warn("Error proxying", "err", err)
+	if ack {
+		if _, err := session.Control().Write(commands.NewInitAckCommand(command.ID).Bytes()); err != nil {
+			log.Error("Unable to acknowledge connection", "id", command.ID, "err", err)
 			return
 		}
-	}()
-	if _, err := io.Copy(portalConn, localConn); err != nil {
-		log.Warn("Error proxying", "err", err)
+	}
+	if m.Protocol == mapping.ProtocolUDP {
+		l.proxyDatagrams(stream, localConn)
+		log.Info("Flow terminated", "id", command.ID)
 		return
 	}
-	log.Info("Proxy connection terminated")
+	if l.proxyProtocol != "" {
+		if _, err := localConn.Write(proxyproto.Header(l.proxyProtocol, command.Source, command.Destination)); err != nil {
+			log.Error("Unable to send proxy protocol header", "id", command.ID, "err", err)
+			return
+		}
+	}
+	if err := proxy.Pipe(stream, localConn); err != nil {
+		log.Warn("Error proxying", "id", command.ID, "err", err)
+		return
+	}
+	log.Info("Proxy connection terminated", "id", command.ID)
+}
+
+func (l Local) reportDialFailure(session *mux.Session, id, reason string) {
+	if _, err := session.Control().Write(commands.NewDialFailedCommand(id, reason).Bytes()); err != nil {
+		log.Error("Unable to report dial failure", "id", id, "err", err)
+	}
+}
+
+// proxyDatagrams proxies the datagrams of a flow until the stream ends. The local connection is closed then, as
+// a udp read has no end of its own.
+func (l Local) proxyDatagrams(stream, localConn net.Conn) {
+	defer localConn.Close()
+	l.spawn(func() {
+		defer stream.Close()
+		buf := make([]byte, mux.MaxDatagramSize)
+		for {
+			n, err := localConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := mux.WriteDatagram(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	})
+	buf := make([]byte, mux.MaxDatagramSize)
+	for {
+		datagram, err := mux.ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		if _, err := localConn.Write(datagram); err != nil {
+			log.Warn("Error sending datagram", "err", err)
+		}
+	}
 }
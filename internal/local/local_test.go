@@ -0,0 +1,194 @@
+package local
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/mux"
+)
+
+// sessionPair returns the session of the local component and the session of the remote component, connected by
+// an in-memory connection.
+func sessionPair(t *testing.T) (*mux.Session, *mux.Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	local, remote := mux.Client(a), mux.Server(b)
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// testLocal returns a local component with the mappings. The goroutines it spawns are added to spawned.
+func testLocal(t *testing.T, spawned *sync.WaitGroup, specs ...string) Local {
+	t.Helper()
+	mappings, err := mapping.ParseAll(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocalComponent(mappings, "", "", nil, "", func(f func()) {
+		spawned.Add(1)
+		go func() {
+			defer spawned.Done()
+			f()
+		}()
+	})
+}
+
+// waitGroup waits for the wait group, failing the test after the timeout.
+func waitGroup(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("still waiting after %s", timeout)
+	}
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, mux.MaxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	var spawned sync.WaitGroup
+	l := testLocal(t, &spawned, fmt.Sprintf("%s:53/udp", echo.LocalAddr()))
+	localSession, remoteSession := sessionPair(t)
+	remote, err := remoteSession.Open(commands.NewInitCommand("53", mapping.ProtocolUDP, "10.0.0.1:1234", "10.0.0.2:53").Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := localSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := commands.ParseCommand(stream.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{})
+	go func() {
+		l.handleInitCommand(localSession, stream, command, false)
+		close(handled)
+	}()
+
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, mux.MaxDatagramSize)
+	for _, datagram := range []string{"first", "second datagram"} {
+		if err := mux.WriteDatagram(remote, []byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := mux.ReadDatagram(remote, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != datagram {
+			t.Errorf("echoed %q, want %q", got, datagram)
+		}
+	}
+
+	// ending the stream ends the flow in both directions
+	remote.CloseWrite()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow still running after the stream ended")
+	}
+	waitGroup(t, &spawned, 5*time.Second)
+}
+
+func TestProxyDatagramsEndsWithStream(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	var spawned sync.WaitGroup
+	l := testLocal(t, &spawned, fmt.Sprintf("%s:53/udp", target.LocalAddr()))
+	localConn, err := l.mappings[0].Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localSession, remoteSession := sessionPair(t)
+	remote, err := remoteSession.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := localSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.CloseWrite()
+	// the target never answers, so only closing the local connection ends the read of the flow
+	l.proxyDatagrams(stream, localConn)
+	waitGroup(t, &spawned, 5*time.Second)
+}
+
+// handshakeWith runs the handshake of the local component with a control server answering with the reply.
+func handshakeWith(t *testing.T, reply commands.Command) ([]string, error) {
+	t.Helper()
+	localSession, remoteSession := sessionPair(t)
+	go func() {
+		control := remoteSession.Control()
+		if _, err := commands.ReadCommand(bufio.NewReader(control)); err != nil {
+			return
+		}
+		control.Write(reply.Bytes())
+	}()
+	var spawned sync.WaitGroup
+	return testLocal(t, &spawned).handshake(localSession, bufio.NewReader(localSession.Control()))
+}
+
+func TestHandshake(t *testing.T) {
+	incompatible := commands.NewHelloCommand(commands.SupportedFeatures, "")
+	incompatible.Protocol = commands.ProtocolVersion + 1
+	tests := []struct {
+		name     string
+		reply    commands.Command
+		features []string
+		err      error
+	}{
+		{
+			name:     "compatible",
+			reply:    commands.NewHelloCommand([]string{commands.FeatureInitAck, "unknown"}, ""),
+			features: []string{commands.FeatureInitAck},
+		},
+		{name: "incompatible protocol", reply: incompatible, err: ErrIncompatible},
+		{name: "rejected token", reply: commands.NewErrorCommand(commands.ErrAuthenticationFailed.Error()), err: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			features, err := handshakeWith(t, tt.reply)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("handshake = %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(features, tt.features) {
+				t.Errorf("features = %v, want %v", features, tt.features)
+			}
+		})
+	}
+}
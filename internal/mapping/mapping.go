@@ -0,0 +1,191 @@
+// Package mapping parses the port mappings given to the k8s command.
+package mapping
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+
+	networkUnix = "unix"
+	unixPrefix  = "unix:"
+)
+
+// Mapping exposes a local target as a port of the remote service.
+type Mapping struct {
+	// TargetNetwork is the network used to reach the target. One of tcp, udp or unix
+	TargetNetwork string
+	// TargetAddr is either a host:port or the path of a unix socket
+	TargetAddr  string
+	ServicePort string
+	Protocol    string
+}
+
+func (m Mapping) String() string {
+	return m.TargetAddr + " -> " + m.ServicePortSpec()
+}
+
+// ServicePortSpec returns the service port in the form accepted by the remote component.
+func (m Mapping) ServicePortSpec() string {
+	return m.ServicePort + "/" + m.Protocol
+}
+
+// PortName is the name of the port in the k8s service.
+func (m Mapping) PortName() string {
+	return m.Protocol + "-" + m.ServicePort
+}
+
+// KubeProtocol is the protocol of the port in the k8s service.
+func (m Mapping) KubeProtocol() string {
+	return strings.ToUpper(m.Protocol)
+}
+
+// Dial connects to the target, giving up after the timeout.
+func (m Mapping) Dial(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(m.TargetNetwork, m.TargetAddr, timeout)
+}
+
+// Parse parses a mapping of the form TARGET[:SERVICE_PORT][/PROTOCOL], where TARGET is one of
+//   - PORT, a port on the local machine
+//   - HOST:PORT, any address reachable from the local machine
+//   - unix:PATH or an absolute PATH, a unix socket. The service port is required for unix sockets
+//
+// If the service port is not specified, the port of the target is used as the service port.
+// The protocol defaults to tcp.
+func Parse(spec string) (Mapping, error) {
+	m, err := parse(spec)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("invalid mapping %q: %w", spec, err)
+	}
+	return m, nil
+}
+
+func parse(spec string) (Mapping, error) {
+	if strings.HasPrefix(spec, unixPrefix) || strings.HasPrefix(spec, "/") {
+		return parseUnix(strings.TrimPrefix(spec, unixPrefix))
+	}
+	target, protocol, err := cutProtocol(spec)
+	if err != nil {
+		return Mapping{}, err
+	}
+	var host, port, servicePort string
+	if strings.HasPrefix(target, "[") {
+		end := strings.Index(target, "]:")
+		if end < 0 {
+			return Mapping{}, fmt.Errorf("invalid target %q", target)
+		}
+		host = target[1:end]
+		port, servicePort, _ = strings.Cut(target[end+2:], ":")
+	} else {
+		parts := strings.Split(target, ":")
+		switch {
+		case len(parts) == 1:
+			port = parts[0]
+		case len(parts) == 2 && validatePort(parts[0]) == nil:
+			port, servicePort = parts[0], parts[1]
+		case len(parts) == 2:
+			host, port = parts[0], parts[1]
+		case len(parts) == 3:
+			host, port, servicePort = parts[0], parts[1], parts[2]
+		default:
+			return Mapping{}, fmt.Errorf("invalid target %q", target)
+		}
+	}
+	if servicePort == "" {
+		servicePort = port
+	}
+	if err := validatePort(port); err != nil {
+		return Mapping{}, err
+	}
+	if err := validatePort(servicePort); err != nil {
+		return Mapping{}, err
+	}
+	return Mapping{
+		TargetNetwork: protocol,
+		TargetAddr:    net.JoinHostPort(host, port),
+		ServicePort:   servicePort,
+		Protocol:      protocol,
+	}, nil
+}
+
+func parseUnix(spec string) (Mapping, error) {
+	protocol := ProtocolTCP
+	if rest, ok := strings.CutSuffix(spec, "/"+ProtocolTCP); ok {
+		spec = rest
+	} else if strings.HasSuffix(spec, "/"+ProtocolUDP) {
+		return Mapping{}, fmt.Errorf("unix socket targets support only tcp")
+	}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return Mapping{}, fmt.Errorf("service port is required for unix socket targets")
+	}
+	path, servicePort := spec[:i], spec[i+1:]
+	if path == "" {
+		return Mapping{}, fmt.Errorf("unix socket path is empty")
+	}
+	if err := validatePort(servicePort); err != nil {
+		return Mapping{}, err
+	}
+	return Mapping{
+		TargetNetwork: networkUnix,
+		TargetAddr:    path,
+		ServicePort:   servicePort,
+		Protocol:      protocol,
+	}, nil
+}
+
+// ParseAll parses all the mappings and makes sure no service port is used twice for the same protocol.
+func ParseAll(specs []string) ([]Mapping, error) {
+	var mappings []Mapping
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		m, err := Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[m.ServicePortSpec()] {
+			return nil, fmt.Errorf("service port %s is mapped more than once", m.ServicePortSpec())
+		}
+		seen[m.ServicePortSpec()] = true
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// ParseServicePort parses a service port of the form PORT[/PROTOCOL].
+func ParseServicePort(spec string) (string, string, error) {
+	port, protocol, err := cutProtocol(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid service port %q: %w", spec, err)
+	}
+	if err := validatePort(port); err != nil {
+		return "", "", fmt.Errorf("invalid service port %q: %w", spec, err)
+	}
+	return port, protocol, nil
+}
+
+func cutProtocol(spec string) (string, string, error) {
+	rest, protocol, found := strings.Cut(spec, "/")
+	if !found {
+		return spec, ProtocolTCP, nil
+	}
+	protocol = strings.ToLower(protocol)
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		return "", "", fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	return rest, protocol, nil
+}
+
+func validatePort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
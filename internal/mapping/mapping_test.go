@@ -0,0 +1,128 @@
+package mapping
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mapping
+	}{
+		{spec: "8080", want: Mapping{TargetNetwork: "tcp", TargetAddr: ":8080", ServicePort: "8080", Protocol: "tcp"}},
+		{spec: "8080:80", want: Mapping{TargetNetwork: "tcp", TargetAddr: ":8080", ServicePort: "80", Protocol: "tcp"}},
+		{spec: "8125/udp", want: Mapping{TargetNetwork: "udp", TargetAddr: ":8125", ServicePort: "8125", Protocol: "udp"}},
+		{spec: "8125:125/UDP", want: Mapping{TargetNetwork: "udp", TargetAddr: ":8125", ServicePort: "125", Protocol: "udp"}},
+		{spec: "db.internal:5432", want: Mapping{TargetNetwork: "tcp", TargetAddr: "db.internal:5432", ServicePort: "5432", Protocol: "tcp"}},
+		{spec: "db.internal:5432:15432", want: Mapping{TargetNetwork: "tcp", TargetAddr: "db.internal:5432", ServicePort: "15432", Protocol: "tcp"}},
+		{spec: "10.0.0.1:53:53/udp", want: Mapping{TargetNetwork: "udp", TargetAddr: "10.0.0.1:53", ServicePort: "53", Protocol: "udp"}},
+		{spec: "[::1]:8080", want: Mapping{TargetNetwork: "tcp", TargetAddr: "[::1]:8080", ServicePort: "8080", Protocol: "tcp"}},
+		{spec: "[fe80::1]:8080:80/udp", want: Mapping{TargetNetwork: "udp", TargetAddr: "[fe80::1]:8080", ServicePort: "80", Protocol: "udp"}},
+		{spec: "unix:/tmp/app.sock:80", want: Mapping{TargetNetwork: "unix", TargetAddr: "/tmp/app.sock", ServicePort: "80", Protocol: "tcp"}},
+		{spec: "/var/run/app.sock:80/tcp", want: Mapping{TargetNetwork: "unix", TargetAddr: "/var/run/app.sock", ServicePort: "80", Protocol: "tcp"}},
+		// only the last colon separates the service port of a unix socket
+		{spec: "unix:/tmp/a:b.sock:80", want: Mapping{TargetNetwork: "unix", TargetAddr: "/tmp/a:b.sock", ServicePort: "80", Protocol: "tcp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{spec: "", want: `invalid mapping "": invalid port ""`},
+		{spec: "0", want: `invalid mapping "0": invalid port "0"`},
+		{spec: "70000", want: `invalid mapping "70000": invalid port "70000"`},
+		{spec: "8080:http", want: `invalid mapping "8080:http": invalid port "http"`},
+		{spec: "8080/sctp", want: `invalid mapping "8080/sctp": unsupported protocol "sctp"`},
+		{spec: "db.internal", want: `invalid mapping "db.internal": invalid port "db.internal"`},
+		{spec: "a:1:2:3", want: `invalid mapping "a:1:2:3": invalid target "a:1:2:3"`},
+		{spec: "::1:8080", want: `invalid mapping "::1:8080": invalid target "::1:8080"`},
+		{spec: "[::1]8080", want: `invalid mapping "[::1]8080": invalid target "[::1]8080"`},
+		{spec: "[::1]:", want: `invalid mapping "[::1]:": invalid port ""`},
+		{spec: "/var/run/app.sock", want: `invalid mapping "/var/run/app.sock": service port is required for unix socket targets`},
+		{spec: "unix:/var/run/app.sock:80/udp", want: `invalid mapping "unix:/var/run/app.sock:80/udp": unix socket targets support only tcp`},
+		{spec: "unix::80", want: `invalid mapping "unix::80": unix socket path is empty`},
+		{spec: "unix:/tmp/app.sock:http", want: `invalid mapping "unix:/tmp/app.sock:http": invalid port "http"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			m, err := Parse(tt.spec)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Parse = %+v, %v, want %q", m, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		want  string
+	}{
+		{name: "distinct", specs: []string{"8080:80", "8081:81", "/tmp/app.sock:82"}},
+		{name: "same port over tcp and udp", specs: []string{"8080:53", "8053:53/udp"}},
+		{name: "duplicate service port", specs: []string{"8080:80", "db.internal:5432:80"}, want: "service port 80/tcp is mapped more than once"},
+		{name: "duplicate default service port", specs: []string{"8080", "remote:8080"}, want: "service port 8080/tcp is mapped more than once"},
+		{name: "invalid mapping", specs: []string{"8080", "8081/sctp"}, want: `invalid mapping "8081/sctp": unsupported protocol "sctp"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := ParseAll(tt.specs)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(mappings) != len(tt.specs) {
+					t.Errorf("got %d mappings, want %d", len(mappings), len(tt.specs))
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("ParseAll = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServicePort(t *testing.T) {
+	tests := []struct {
+		spec     string
+		port     string
+		protocol string
+		err      string
+	}{
+		{spec: "80", port: "80", protocol: "tcp"},
+		{spec: "53/udp", port: "53", protocol: "udp"},
+		{spec: "53/UDP", port: "53", protocol: "udp"},
+		{spec: "80/sctp", err: `invalid service port "80/sctp": unsupported protocol "sctp"`},
+		{spec: "http", err: `invalid service port "http": invalid port "http"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			port, protocol, err := ParseServicePort(tt.spec)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("ParseServicePort = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tt.port || protocol != tt.protocol {
+				t.Errorf("ParseServicePort = %s, %s, want %s, %s", port, protocol, tt.port, tt.protocol)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in the prometheus text format.
+//
+// It stands in for prometheus/client_golang, which would add its dependencies (protobuf, procfs, prometheus/common)
+// to the one binary that is both the local command and the remote image, for the few metrics of the remote
+// component. Only the text format is served, and metrics_test.go pins its escaping and bucket output, so keep
+// new metrics to counters, gauges and histograms with labels, or switch to client_golang.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the metrics of the remote component are registered with.
+var Default = NewRegistry()
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, c.value.Load())
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, g.value.Load())
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	// sum holds the bits of a float64
+	sum atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bucket := range h.buckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(bucket)), cumulative)
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(math.Float64frombits(h.sum.Load())))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+type metric interface {
+	write(w io.Writer, name, labels string)
+}
+
+// Vec is a metric family. Every combination of label values is a separate metric of the family.
+type Vec[T metric] struct {
+	name     string
+	help     string
+	typ      string
+	labels   []string
+	create   func() T
+	lock     sync.Mutex
+	children map[string]T
+	keys     []string
+}
+
+// With returns the metric for the label values, which are given in the order of the labels of the family.
+func (v *Vec[T]) With(values ...string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	var key strings.Builder
+	for i, value := range values {
+		if i > 0 {
+			key.WriteByte(',')
+		}
+		fmt.Fprintf(&key, "%s=%q", v.labels[i], escape(value))
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	child, ok := v.children[key.String()]
+	if !ok {
+		child = v.create()
+		v.children[key.String()] = child
+		v.keys = append(v.keys, key.String())
+		sort.Strings(v.keys)
+	}
+	return child
+}
+
+func (v *Vec[T]) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, helpEscaper.Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, key := range v.keys {
+		labels := ""
+		if key != "" {
+			labels = "{" + key + "}"
+		}
+		v.children[key].write(w, v.name, labels)
+	}
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	lock     sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func newVec[T metric](r *Registry, name, help, typ string, labels []string, create func() T) *Vec[T] {
+	v := &Vec[T]{name: name, help: help, typ: typ, labels: labels, create: create, children: make(map[string]T)}
+	if len(labels) == 0 {
+		// metrics without labels are exposed even before they are first used
+		v.With()
+	}
+	r.lock.Lock()
+	r.families = append(r.families, v)
+	r.lock.Unlock()
+	return v
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *Vec[*Counter] {
+	return newVec(r, name, help, "counter", labels, func() *Counter { return new(Counter) })
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec[*Gauge] {
+	return newVec(r, name, help, "gauge", labels, func() *Gauge { return new(Gauge) })
+}
+
+// Histogram registers a histogram with the given upper bounds, which must be sorted.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Vec[*Histogram] {
+	return newVec(r, name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })
+}
+
+// Write writes all the metrics in the prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.lock.Lock()
+	families := r.families
+	r.lock.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+func withLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// helpEscaper escapes help texts as the text format requires.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// escape prepares a label value for %q, which already escapes backslashes, quotes and newlines the same way
+// as the text format. Other non printable characters are not expected in label values.
+func escape(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func write(r *Registry) string {
+	var b strings.Builder
+	r.Write(&b)
+	return b.String()
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	r := NewRegistry()
+	total := r.Counter("test_total", "Total things.")
+	active := r.Gauge("test_active", "Active things.", "port")
+	total.With().Add(3)
+	total.With().Inc()
+	active.With("8080").Inc()
+	active.With("8080").Inc()
+	active.With("8080").Dec()
+	active.With("53").Set(-2)
+	want := `# HELP test_total Total things.
+# TYPE test_total counter
+test_total 4
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active{port="53"} -2
+test_active{port="8080"} 1
+`
+	if got := write(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnusedFamilies(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_plain_total", "Without labels.")
+	r.Counter("test_labelled_total", "With labels.", "port")
+	// metrics without labels are shown from the start, the others once used
+	want := `# HELP test_plain_total Without labels.
+# TYPE test_plain_total counter
+test_plain_total 0
+# HELP test_labelled_total With labels.
+# TYPE test_labelled_total counter
+`
+	if got := write(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	errors := r.Counter("test_errors_total", "Errors, by \"reason\".\nA path looks like C:\\dir.", "reason", "path")
+	errors.With(`said "no"`, `C:\dir`).Inc()
+	errors.With("line\nbreak", "tab\there").Inc()
+	errors.With("ünïcode", "").Inc()
+	want := `# HELP test_errors_total Errors, by "reason".\nA path looks like C:\\dir.
+# TYPE test_errors_total counter
+test_errors_total{reason="line\nbreak",path="tabhere"} 1
+test_errors_total{reason="said \"no\"",path="C:\\dir"} 1
+test_errors_total{reason="ünïcode",path=""} 1
+`
+	if got := write(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	duration := r.Histogram("test_duration_seconds", "Durations.", []float64{0.1, 1, 10}, "port")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2, 20, 30} {
+		duration.With("80").Observe(v)
+	}
+	duration.With("443")
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{port="443",le="0.1"} 0
+test_duration_seconds_bucket{port="443",le="1"} 0
+test_duration_seconds_bucket{port="443",le="10"} 0
+test_duration_seconds_bucket{port="443",le="+Inf"} 0
+test_duration_seconds_sum{port="443"} 0
+test_duration_seconds_count{port="443"} 0
+test_duration_seconds_bucket{port="80",le="0.1"} 2
+test_duration_seconds_bucket{port="80",le="1"} 3
+test_duration_seconds_bucket{port="80",le="10"} 4
+test_duration_seconds_bucket{port="80",le="+Inf"} 6
+test_duration_seconds_sum{port="80"} 52.65
+test_duration_seconds_count{port="80"} 6
+`
+	if got := write(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	r.Histogram("test_size_bytes", "Sizes.", []float64{1024}).With().Observe(4096)
+	want := `# HELP test_size_bytes Sizes.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="1024"} 0
+test_size_bytes_bucket{le="+Inf"} 1
+test_size_bytes_sum 4096
+test_size_bytes_count 1
+`
+	if got := write(r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Total things.")
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if got, want := recorder.Body.String(), write(r); got != want {
+		t.Errorf("body\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxDatagramSize is the largest datagram that can be sent with WriteDatagram.
+const MaxDatagramSize = 0xffff
+
+var errDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram writes the datagram prefixed with its length so that the datagram boundaries survive the stream.
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return errDatagramTooLarge
+	}
+	buf := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(buf, uint16(len(datagram)))
+	copy(buf[2:], datagram)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads a datagram written with WriteDatagram into buf. buf should be at least MaxDatagramSize long.
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > len(buf) {
+		return nil, errDatagramTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:length]); err != nil {
+		return nil, err
+	}
+	return buf[:length], nil
+}
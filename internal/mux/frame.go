@@ -0,0 +1,81 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type frameType uint8
+
+const (
+	typeOpen frameType = iota
+	typeData
+	typeClose
+	typeReset
+	typeWindow
+)
+
+func (t frameType) String() string {
+	switch t {
+	case typeOpen:
+		return "open"
+	case typeData:
+		return "data"
+	case typeClose:
+		return "close"
+	case typeReset:
+		return "reset"
+	case typeWindow:
+		return "window"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+const (
+	// headerSize is the size of the frame header: type (1 byte), stream id (4 bytes) and payload length (4 bytes).
+	headerSize = 9
+	// maxPayloadSize is the largest payload a single frame can carry.
+	maxPayloadSize = 32 * 1024
+	// initialWindow is the number of bytes a peer can send on a stream before waiting for a window update.
+	initialWindow = 256 * 1024
+)
+
+var errFrameTooLarge = errors.New("frame payload too large")
+
+type frame struct {
+	typ      frameType
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) encode() []byte {
+	buf := make([]byte, headerSize+len(f.payload))
+	buf[0] = byte(f.typ)
+	binary.BigEndian.PutUint32(buf[1:5], f.streamID)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(f.payload)))
+	copy(buf[headerSize:], f.payload)
+	return buf
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxPayloadSize {
+		return frame{}, errFrameTooLarge
+	}
+	f := frame{
+		typ:      frameType(header[0]),
+		streamID: binary.BigEndian.Uint32(header[1:5]),
+		payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
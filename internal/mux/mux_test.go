@@ -0,0 +1,269 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	frames := []frame{
+		{typ: typeOpen, streamID: 2, payload: []byte("metadata")},
+		{typ: typeData, streamID: 1<<32 - 1, payload: bytes.Repeat([]byte{'x'}, maxPayloadSize)},
+		{typ: typeClose, streamID: 3, payload: []byte{}},
+		{typ: typeReset, streamID: 4, payload: []byte{}},
+		{typ: typeWindow, streamID: 5, payload: []byte{0, 0, 1, 0}},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		buf.Write(f.encode())
+	}
+	for _, want := range frames {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("readFrame(%s): %v", want.typ, err)
+		}
+		if got.typ != want.typ || got.streamID != want.streamID || !bytes.Equal(got.payload, want.payload) {
+			t.Errorf("readFrame = %s %d %d bytes, want %s %d %d bytes", got.typ, got.streamID, len(got.payload), want.typ, want.streamID, len(want.payload))
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Errorf("readFrame at the end = %v, want EOF", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	header := frame{typ: typeData, streamID: 1}.encode()
+	header[5], header[6], header[7], header[8] = 0, 0, 0x80, 1
+	if _, err := readFrame(bytes.NewReader(header)); err != errFrameTooLarge {
+		t.Errorf("readFrame = %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+// sessionPair returns a client and a server session connected by an in-memory connection.
+func sessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// rawPeer returns a connection to a session which exchanges frames directly.
+func rawPeer(t *testing.T, newSession func(net.Conn) *Session) (*Session, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	session := newSession(a)
+	t.Cleanup(func() {
+		session.Close()
+		b.Close()
+	})
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	return session, b
+}
+
+func writeFrames(t *testing.T, conn net.Conn, frames ...frame) {
+	t.Helper()
+	for _, f := range frames {
+		if _, err := conn.Write(f.encode()); err != nil {
+			t.Fatalf("writing %s frame: %v", f.typ, err)
+		}
+	}
+}
+
+// readFrameOf reads frames until one of the type, skipping the others.
+func readFrameOf(t *testing.T, conn net.Conn, typ frameType) frame {
+	t.Helper()
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("waiting for %s frame: %v", typ, err)
+		}
+		if f.typ == typ {
+			return f
+		}
+	}
+}
+
+func TestStreamOpenAndData(t *testing.T) {
+	client, server := sessionPair(t)
+	out, err := server.Open([]byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(in.Metadata()) != "metadata" {
+		t.Errorf("Metadata = %q, want %q", in.Metadata(), "metadata")
+	}
+	go func() {
+		out.Write([]byte("hello"))
+		out.CloseWrite()
+	}()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("read %q, want %q", data, "hello")
+	}
+}
+
+func TestFlowControlWindow(t *testing.T) {
+	client, server := sessionPair(t)
+	out, err := server.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*initialWindow)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// nothing is read, so the writer stops once the window is used up
+	out.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := out.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != initialWindow {
+		t.Fatalf("Write = %d, %v, want %d, %v", n, err, initialWindow, os.ErrDeadlineExceeded)
+	}
+	out.SetWriteDeadline(time.Time{})
+	// reading opens the window again
+	done := make(chan error, 1)
+	go func() {
+		_, err := out.Write(data[n:])
+		out.CloseWrite()
+		done <- err
+	}()
+	got, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write after the window update: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes differing from the %d written", len(got), len(data))
+	}
+}
+
+func TestResetOnWindowOverflow(t *testing.T) {
+	session, peer := rawPeer(t, Client)
+	writeFrames(t, peer, frame{typ: typeOpen, streamID: 2})
+	stream, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer ignores the window, and is not reading while it sends
+	chunk := make([]byte, maxPayloadSize)
+	for sent := 0; sent <= initialWindow; sent += len(chunk) {
+		writeFrames(t, peer, frame{typ: typeData, streamID: 2, payload: chunk})
+	}
+	if f := readFrameOf(t, peer, typeReset); f.streamID != 2 {
+		t.Errorf("reset stream %d, want 2", f.streamID)
+	}
+	if _, err := io.Copy(io.Discard, stream); err != ErrStreamClosed {
+		t.Errorf("Read after the reset = %v, want %v", err, ErrStreamClosed)
+	}
+}
+
+func TestResetByPeer(t *testing.T) {
+	session, peer := rawPeer(t, Client)
+	writeFrames(t, peer, frame{typ: typeOpen, streamID: 2})
+	stream, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrames(t, peer, frame{typ: typeReset, streamID: 2})
+	if _, err := stream.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("Read = %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := stream.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("Write = %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestResetUnknownStreams(t *testing.T) {
+	_, peer := rawPeer(t, Client)
+	// every frame is answered with a reset, which must not stop the session from reading while the peer
+	// does not read them
+	const count = 100
+	for i := uint32(0); i < count; i++ {
+		writeFrames(t, peer, frame{typ: typeData, streamID: 2*i + 100, payload: []byte("x")})
+	}
+	for i := uint32(0); i < count; i++ {
+		if f := readFrameOf(t, peer, typeReset); f.streamID != 2*i+100 {
+			t.Fatalf("reset stream %d, want %d", f.streamID, 2*i+100)
+		}
+	}
+}
+
+func TestServerResetsPeerStreams(t *testing.T) {
+	_, peer := rawPeer(t, Server)
+	writeFrames(t, peer, frame{typ: typeOpen, streamID: 1})
+	if f := readFrameOf(t, peer, typeReset); f.streamID != 1 {
+		t.Errorf("reset stream %d, want 1", f.streamID)
+	}
+}
+
+func TestResetWhenAcceptBacklogFull(t *testing.T) {
+	session, peer := rawPeer(t, Client)
+	backlog := cap(session.acceptChan)
+	for i := 0; i <= backlog; i++ {
+		writeFrames(t, peer, frame{typ: typeOpen, streamID: uint32(2*i + 2)})
+	}
+	if f := readFrameOf(t, peer, typeReset); f.streamID != uint32(2*backlog+2) {
+		t.Errorf("reset stream %d, want %d", f.streamID, 2*backlog+2)
+	}
+}
+
+func TestConcurrentControlWrites(t *testing.T) {
+	client, server := sessionPair(t)
+	const (
+		writers = 8
+		lines   = 4
+		size    = initialWindow + maxPayloadSize
+	)
+	// every line is larger than the window, so every write waits for window updates while others wait to write
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		line := append(bytes.Repeat([]byte{byte('a' + i)}, size), '\n')
+		go func() {
+			for j := 0; j < lines; j++ {
+				if _, err := client.Control().Write(line); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	scanner := bufio.NewScanner(server.Control())
+	scanner.Buffer(make([]byte, size+1), size+1)
+	for n := 0; n < writers*lines; n++ {
+		if !scanner.Scan() {
+			t.Fatalf("read %d lines, want %d: %v", n, writers*lines, scanner.Err())
+		}
+		line := scanner.Bytes()
+		if len(line) != size || len(bytes.Trim(line, string(line[:1]))) != 0 {
+			t.Fatalf("line %d is interleaved with other writes", n)
+		}
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
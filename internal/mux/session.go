@@ -0,0 +1,247 @@
+// Package mux multiplexes many bidirectional streams over a single connection.
+//
+// Every frame carries a stream id. Stream 0 is the control stream and is open
+// on both sides for the whole lifetime of the session. All other streams are
+// created with an open frame carrying arbitrary metadata, and are flow
+// controlled with a per-stream receive window.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+const ControlStreamID uint32 = 0
+
+// maxQueuedControlFrames is the number of control frames which can wait for the connection. A peer which sends
+// more frames without reading the replies is dropped.
+const maxQueuedControlFrames = 1024
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamReset   = errors.New("stream reset by peer")
+)
+
+type Session struct {
+	conn        net.Conn
+	writeLock   sync.Mutex
+	streams     map[uint32]*Stream
+	streamsLock sync.Mutex
+	nextID      uint32
+	acceptChan  chan *Stream
+	// acceptStreams is unset on the server side, which only opens streams
+	acceptStreams bool
+	control       *Stream
+	// controlFrames are written by writeLoop, so that the read loop never waits for the connection
+	controlFrames []frame
+	controlLock   sync.Mutex
+	controlNotify chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// Client returns a session for the side that dialed the connection.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1, true)
+}
+
+// Server returns a session for the side that accepted the connection. Streams opened by the peer are reset.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2, false)
+}
+
+func newSession(conn net.Conn, firstID uint32, acceptStreams bool) *Session {
+	s := &Session{
+		conn:          conn,
+		streams:       make(map[uint32]*Stream),
+		nextID:        firstID,
+		acceptChan:    make(chan *Stream, 64),
+		acceptStreams: acceptStreams,
+		controlNotify: make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+	}
+	s.control = newStream(s, ControlStreamID, nil)
+	s.streams[ControlStreamID] = s.control
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+// Control returns the control stream of the session.
+func (s *Session) Control() *Stream {
+	return s.control
+}
+
+// Open creates a new stream. The metadata is delivered to the peer along with the stream.
+func (s *Session) Open(metadata []byte) (*Stream, error) {
+	if len(metadata) > maxPayloadSize {
+		return nil, errFrameTooLarge
+	}
+	s.streamsLock.Lock()
+	select {
+	case <-s.closed:
+		s.streamsLock.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id, metadata)
+	s.streams[id] = stream
+	s.streamsLock.Unlock()
+	if err := s.writeFrame(frame{typ: typeOpen, streamID: id, payload: metadata}); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a new stream. Streams opened while 64 others wait to be accepted are reset.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptChan:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Done is closed when the session is terminated.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		s.streamsLock.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.streamsLock.Unlock()
+		for _, stream := range streams {
+			stream.terminate(ErrSessionClosed)
+		}
+	})
+	return err
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) readLoop() {
+	defer s.Close()
+	for {
+		f, err := readFrame(s.conn)
+		if err != nil {
+			return
+		}
+		if f.typ == typeOpen {
+			s.handleOpen(f)
+			continue
+		}
+		s.streamsLock.Lock()
+		stream := s.streams[f.streamID]
+		s.streamsLock.Unlock()
+		if stream == nil {
+			if f.typ != typeReset {
+				s.queueFrame(frame{typ: typeReset, streamID: f.streamID})
+			}
+			continue
+		}
+		switch f.typ {
+		case typeData:
+			if !stream.receiveData(f.payload) {
+				stream.reset()
+			}
+		case typeClose:
+			stream.receiveClose()
+		case typeReset:
+			stream.terminate(ErrStreamReset)
+		case typeWindow:
+			if len(f.payload) == 4 {
+				stream.receiveWindow(binary.BigEndian.Uint32(f.payload))
+			}
+		}
+	}
+}
+
+func (s *Session) handleOpen(f frame) {
+	s.streamsLock.Lock()
+	if _, ok := s.streams[f.streamID]; ok || f.streamID%2 == s.nextID%2 || !s.acceptStreams {
+		s.streamsLock.Unlock()
+		s.queueFrame(frame{typ: typeReset, streamID: f.streamID})
+		return
+	}
+	stream := newStream(s, f.streamID, f.payload)
+	s.streams[f.streamID] = stream
+	s.streamsLock.Unlock()
+	select {
+	case s.acceptChan <- stream:
+	default:
+		stream.reset()
+	}
+}
+
+func (s *Session) writeFrame(f frame) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+	if _, err := s.conn.Write(f.encode()); err != nil {
+		go s.Close()
+		return err
+	}
+	return nil
+}
+
+// queueFrame queues the frame to be written by writeLoop. It does not block, so it is safe to call from the
+// read loop.
+func (s *Session) queueFrame(f frame) {
+	s.controlLock.Lock()
+	if len(s.controlFrames) >= maxQueuedControlFrames {
+		s.controlLock.Unlock()
+		go s.Close()
+		return
+	}
+	s.controlFrames = append(s.controlFrames, f)
+	s.controlLock.Unlock()
+	notify(s.controlNotify)
+}
+
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case <-s.controlNotify:
+		case <-s.closed:
+			return
+		}
+		s.controlLock.Lock()
+		frames := s.controlFrames
+		s.controlFrames = nil
+		s.controlLock.Unlock()
+		for _, f := range frames {
+			if err := s.writeFrame(f); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.streamsLock.Lock()
+	delete(s.streams, id)
+	s.streamsLock.Unlock()
+}
@@ -0,0 +1,284 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a single bidirectional, flow controlled stream inside a Session. It implements net.Conn.
+type Stream struct {
+	id       uint32
+	session  *Session
+	metadata []byte
+	// writeLock is held for the whole of a Write, so that the frames of concurrent writes do not interleave
+	writeLock sync.Mutex
+
+	lock          sync.Mutex
+	readBuf       bytes.Buffer
+	consumed      uint32
+	sendWindow    uint32
+	remoteClosed  bool
+	writeClosed   bool
+	readClosed    bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	// writeReady is closed and replaced whenever a blocked writer may continue
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32, metadata []byte) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		metadata:   metadata,
+		sendWindow: initialWindow,
+		readNotify: make(chan struct{}, 1),
+		writeReady: make(chan struct{}),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Metadata returns the metadata sent by the peer while opening the stream.
+func (s *Stream) Metadata() []byte {
+	return s.metadata
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.readBuf.Len() > 0 {
+			n, _ := s.readBuf.Read(b)
+			s.consumed += uint32(n)
+			var increment uint32
+			if s.consumed >= initialWindow/4 && !s.remoteClosed {
+				increment, s.consumed = s.consumed, 0
+			}
+			s.lock.Unlock()
+			if increment > 0 {
+				s.sendWindowUpdate(increment)
+			}
+			return n, nil
+		}
+		switch {
+		case s.readClosed:
+			s.lock.Unlock()
+			return 0, ErrStreamClosed
+		case s.remoteClosed:
+			s.lock.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.lock.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.lock.Unlock()
+		if err := s.wait(s.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as data frames of the stream. It is safe to call from concurrent goroutines, and the data of
+// one call is never interleaved with the data of another.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	written := 0
+	for written < len(b) {
+		s.lock.Lock()
+		switch {
+		case s.writeClosed:
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		case s.err != nil:
+			err := s.err
+			s.lock.Unlock()
+			return written, err
+		}
+		if s.sendWindow == 0 {
+			deadline, ready := s.writeDeadline, s.writeReady
+			s.lock.Unlock()
+			if err := s.wait(ready, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b)-written, int(s.sendWindow), maxPayloadSize)
+		s.sendWindow -= uint32(n)
+		s.lock.Unlock()
+		if err := s.session.writeFrame(frame{typ: typeData, streamID: s.id, payload: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite closes the write side of the stream. The peer reads io.EOF once it has read all the data
+// sent before. The stream can still be read from.
+func (s *Stream) CloseWrite() error {
+	return s.close(false)
+}
+
+// Close closes the stream. Pending and further data from the peer is discarded.
+func (s *Stream) Close() error {
+	return s.close(true)
+}
+
+func (s *Stream) close(read bool) error {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	if read && !s.readClosed {
+		s.readClosed = true
+		s.readBuf.Reset()
+	}
+	sendClose := !s.writeClosed
+	s.writeClosed = true
+	done := s.remoteClosed
+	s.wakeWriters()
+	s.lock.Unlock()
+	notify(s.readNotify)
+	if done {
+		s.session.removeStream(s.id)
+	}
+	if !sendClose {
+		return nil
+	}
+	return s.session.writeFrame(frame{typ: typeClose, streamID: s.id})
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.lock.Unlock()
+	notify(s.readNotify)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.wakeWriters()
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-s.session.closed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *Stream) receiveData(data []byte) bool {
+	s.lock.Lock()
+	if s.readClosed {
+		s.lock.Unlock()
+		s.sendWindowUpdate(uint32(len(data)))
+		return true
+	}
+	if s.readBuf.Len()+len(data) > initialWindow {
+		s.lock.Unlock()
+		return false
+	}
+	s.readBuf.Write(data)
+	s.lock.Unlock()
+	notify(s.readNotify)
+	return true
+}
+
+func (s *Stream) receiveClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	done := s.writeClosed
+	s.lock.Unlock()
+	notify(s.readNotify)
+	if done {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) receiveWindow(increment uint32) {
+	s.lock.Lock()
+	s.sendWindow += increment
+	s.wakeWriters()
+	s.lock.Unlock()
+}
+
+// reset aborts the stream on both sides.
+func (s *Stream) reset() {
+	s.terminate(ErrStreamClosed)
+	s.session.queueFrame(frame{typ: typeReset, streamID: s.id})
+}
+
+func (s *Stream) terminate(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.wakeWriters()
+	s.lock.Unlock()
+	notify(s.readNotify)
+	s.session.removeStream(s.id)
+}
+
+// wakeWriters wakes every writer waiting for the window. It must be called with the lock held.
+func (s *Stream) wakeWriters() {
+	close(s.writeReady)
+	s.writeReady = make(chan struct{})
+}
+
+func (s *Stream) sendWindowUpdate(increment uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	s.session.queueFrame(frame{typ: typeWindow, streamID: s.id, payload: payload})
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
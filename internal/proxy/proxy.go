@@ -0,0 +1,51 @@
+// Package proxy copies data between two connections.
+package proxy
+
+import (
+	"io"
+	"net"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data between a and b in both the directions. When one direction reaches EOF, the
+// write side of its destination is closed, so that half-closes are propagated. Both the
+// connections are closed once both the directions are done, or as soon as one of them fails.
+// The first error encountered is returned.
+func Pipe(a, b net.Conn) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- copyAndCloseWrite(a, b)
+	}()
+	go func() {
+		errs <- copyAndCloseWrite(b, a)
+	}()
+	err := <-errs
+	if err != nil {
+		a.Close()
+		b.Close()
+	}
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	a.Close()
+	b.Close()
+	return err
+}
+
+// CloseWrite closes the write side of the connection if it supports half-closes, and the whole connection
+// otherwise. Wrappers of connections use it to pass half-closes through.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+func copyAndCloseWrite(dst, src net.Conn) error {
+	_, err := io.Copy(dst, src)
+	CloseWrite(dst)
+	return err
+}
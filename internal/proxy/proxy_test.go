@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/mux"
+)
+
+// target reads the whole request, and only then answers with the request reversed and closes the connection.
+func target(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(reverse(string(request))))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// pipeTo proxies conn to the target in the background.
+func pipeTo(t *testing.T, conn net.Conn, addr string) <-chan error {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		targetConn, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Close()
+			errs <- err
+			return
+		}
+		errs <- Pipe(conn, targetConn)
+	}()
+	return errs
+}
+
+type halfCloser interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// request sends the request, closes the write side and reads the whole response.
+func request(t *testing.T, conn halfCloser, request string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(response)
+}
+
+var payload = strings.Repeat("0123456789abcdef", 64*1024)
+
+func TestPipeHalfCloseTCP(t *testing.T) {
+	addr := target(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	errs := pipeTo(t, conn, addr)
+	if response := request(t, client.(*net.TCPConn), payload); response != reverse(payload) {
+		t.Errorf("response of %d bytes does not match the request of %d bytes", len(response), len(payload))
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Pipe: %v", err)
+	}
+}
+
+func TestPipeHalfCloseMuxStream(t *testing.T) {
+	addr := target(t)
+	a, b := net.Pipe()
+	local, remote := mux.Client(a), mux.Server(b)
+	defer local.Close()
+	defer remote.Close()
+	client, err := remote.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stream, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := pipeTo(t, stream, addr)
+	if response := request(t, client, payload); response != reverse(payload) {
+		t.Errorf("response of %d bytes does not match the request of %d bytes", len(response), len(payload))
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Pipe: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package proxyproto reads and writes PROXY protocol headers, which carry the original client address of
+// a proxied connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/v4run/reversepf/internal/proxy"
+)
+
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+// maxV1HeaderSize is the longest v1 header allowed by the specification, including the CRLF
+const maxV1HeaderSize = 107
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	v2CommandLocal = 0x20
+	v2CommandProxy = 0x21
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+	v2Unspecified  = 0x00
+)
+
+func ParseVersion(version string) (string, error) {
+	switch version {
+	case "", V1, V2:
+		return version, nil
+	default:
+		return "", fmt.Errorf("unknown proxy protocol version %q. Must be one of v1 or v2", version)
+	}
+}
+
+// Header returns the header of the given version for a connection from source to destination. An UNKNOWN
+// (v1) or LOCAL (v2) header is returned when the addresses are missing or are not tcp addresses.
+func Header(version string, source, destination string) []byte {
+	src, srcErr := net.ResolveTCPAddr("tcp", source)
+	dst, dstErr := net.ResolveTCPAddr("tcp", destination)
+	known := srcErr == nil && dstErr == nil && src.IP != nil && dst.IP != nil
+	ipv4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+	if version == V1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+	}
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	if !known {
+		buf.Write([]byte{v2CommandLocal, v2Unspecified, 0, 0})
+		return buf.Bytes()
+	}
+	var srcIP, dstIP net.IP
+	family := byte(v2FamilyTCP6)
+	if ipv4 {
+		family, srcIP, dstIP = v2FamilyTCP4, src.IP.To4(), dst.IP.To4()
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	buf.Write([]byte{v2CommandProxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+// Read reads a v1 or v2 header from the reader and returns the source and destination addresses it carries.
+// Both are nil for UNKNOWN and LOCAL headers, in which case the addresses of the connection should be used.
+func Read(reader *bufio.Reader) (source, destination net.Addr, err error) {
+	// only as many bytes as the header surely has are waited for, as the client may wait for the server once
+	// the header is sent
+	prefix, err := reader.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol header: %w", err)
+	}
+	if bytes.Equal(prefix, v1Prefix) {
+		return readV1(reader)
+	}
+	if !bytes.HasPrefix(v2Signature, prefix) {
+		return nil, nil, errors.New("missing proxy protocol header")
+	}
+	prefix, err = reader.Peek(len(v2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol header: %w", err)
+	}
+	if !bytes.Equal(prefix, v2Signature) {
+		return nil, nil, errors.New("missing proxy protocol header")
+	}
+	return readV2(reader)
+}
+
+func readV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderSize {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading proxy protocol header: %w", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header %q", strings.TrimSpace(string(line)))
+	}
+	source, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q in proxy protocol header", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in proxy protocol header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol header: %w", err)
+	}
+	command, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol header: %w", err)
+	}
+	if command&0xF0 != 0x20 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version %#x", command>>4)
+	}
+	if command == v2CommandLocal {
+		return nil, nil, nil
+	}
+	size := 0
+	switch family {
+	case v2FamilyTCP4:
+		size = net.IPv4len
+	case v2FamilyTCP6:
+		size = net.IPv6len
+	default:
+		// other families carry no address usable here
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("proxy protocol header too short")
+	}
+	source := &net.TCPAddr{IP: net.IP(payload[:size]), Port: int(binary.BigEndian.Uint16(payload[2*size:]))}
+	destination := &net.TCPAddr{IP: net.IP(payload[size : 2*size]), Port: int(binary.BigEndian.Uint16(payload[2*size+2:]))}
+	return source, destination, nil
+}
+
+// Conn is a connection whose header has been read. Its addresses are the ones carried by the header.
+type Conn struct {
+	net.Conn
+	reader      *bufio.Reader
+	source      net.Addr
+	destination net.Addr
+}
+
+// NewConn reads the header from the connection. The connection is expected to start with a header.
+func NewConn(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	source, destination, err := Read(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, reader: reader, source: source, destination: destination}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
@@ -0,0 +1,71 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		version, source, destination string
+		known                        bool
+	}{
+		{V1, "10.0.0.1:5000", "10.0.0.2:80", true},
+		{V1, "[2001:db8::1]:5000", "[2001:db8::2]:80", true},
+		{V1, "", "10.0.0.2:80", false},
+		{V2, "10.0.0.1:5000", "10.0.0.2:80", true},
+		{V2, "[2001:db8::1]:5000", "[2001:db8::2]:80", true},
+		{V2, "", "", false},
+	}
+	for _, tt := range tests {
+		reader := bufio.NewReader(bytes.NewReader(append(Header(tt.version, tt.source, tt.destination), "data"...)))
+		source, destination, err := Read(reader)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.version, tt.source, err)
+			continue
+		}
+		if !tt.known {
+			if source != nil || destination != nil {
+				t.Errorf("%s without addresses read %v, %v, want nil", tt.version, source, destination)
+			}
+		} else if source.String() != tt.source || destination.String() != tt.destination {
+			t.Errorf("%s read %v, %v, want %s, %s", tt.version, source, destination, tt.source, tt.destination)
+		}
+		if rest, _ := reader.ReadString(0); rest != "data" {
+			t.Errorf("%s %s: data after the header = %q, want %q", tt.version, tt.source, rest, "data")
+		}
+	}
+}
+
+func TestMissingHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "\r\n\r\nHELLO WORLD"} {
+		if _, _, err := Read(bufio.NewReader(bytes.NewBufferString(data))); err == nil {
+			t.Errorf("Read(%q) succeeded", data)
+		}
+	}
+}
+
+// TestHeaderFromWaitingClient reads the shortest header, sent a byte at a time by a client which then waits
+// for the server.
+func TestHeaderFromWaitingClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		// every byte is written separately
+		for _, b := range []byte("PROXY UNKNOWN\r\n") {
+			client.Write([]byte{b})
+		}
+	}()
+	source, destination, err := Read(bufio.NewReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != nil || destination != nil {
+		t.Errorf("read %v, %v, want nil", source, destination)
+	}
+}
@@ -0,0 +1,100 @@
+package remote
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// FailureAction decides how a client connection is terminated when it cannot be proxied to the local component.
+type FailureAction string
+
+const (
+	// FailureActionClose closes the connection gracefully
+	FailureActionClose FailureAction = "close"
+	// FailureActionReset closes the connection with a TCP RST
+	FailureActionReset FailureAction = "reset"
+	// FailureActionHTTP responds with a 503 Service Unavailable before closing the connection
+	FailureActionHTTP FailureAction = "http"
+)
+
+const httpUnavailableResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Length: 31\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Local component not available.\n"
+
+func ParseFailureAction(action string) (FailureAction, error) {
+	switch a := FailureAction(action); a {
+	case FailureActionClose, FailureActionReset, FailureActionHTTP:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown failure action %q. Must be one of close, reset or http", action)
+	}
+}
+
+func (a FailureAction) terminate(conn net.Conn) {
+	switch a {
+	case FailureActionReset:
+		resetConn(conn)
+	case FailureActionHTTP:
+		conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte(httpUnavailableResponse))
+		conn.Close()
+	default:
+		conn.Close()
+	}
+}
+
+// resetConn closes the connection with a TCP RST instead of a graceful FIN. Wrapped connections are
+// unwrapped to find the tcp connection.
+func resetConn(conn net.Conn) {
+	inner := conn
+	for {
+		wrapped, ok := inner.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		inner = wrapped.NetConn()
+	}
+	if tcpConn, ok := inner.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// Availability decides what happens to new connections while the local component is not connected.
+// Connections are held for up to GracePeriod waiting for the local component, with at most MaxPending
+// connections waiting at a time. Connections which cannot be proxied are terminated with OnFailure.
+type Availability struct {
+	GracePeriod   time.Duration
+	MaxPending    int64
+	OnFailure     FailureAction
+	waitForClient func(time.Duration) bool
+	pending       *atomic.Int64
+}
+
+func NewAvailability(gracePeriod time.Duration, maxPending int64, onFailure FailureAction, waitForClient func(time.Duration) bool) *Availability {
+	return &Availability{
+		GracePeriod:   gracePeriod,
+		MaxPending:    maxPending,
+		OnFailure:     onFailure,
+		waitForClient: waitForClient,
+		pending:       new(atomic.Int64),
+	}
+}
+
+// wait blocks until the local component is connected or the grace period is over. It
+// returns false without waiting if too many connections are already waiting.
+func (a *Availability) wait() bool {
+	if a.GracePeriod <= 0 {
+		return false
+	}
+	defer a.pending.Add(-1)
+	if a.pending.Add(1) > a.MaxPending {
+		return false
+	}
+	return a.waitForClient(a.GracePeriod)
+}
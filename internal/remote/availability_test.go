@@ -0,0 +1,182 @@
+package remote
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+)
+
+func TestParseFailureAction(t *testing.T) {
+	tests := []struct {
+		action string
+		want   FailureAction
+		err    bool
+	}{
+		{action: "close", want: FailureActionClose},
+		{action: "reset", want: FailureActionReset},
+		{action: "http", want: FailureActionHTTP},
+		{action: "drop", err: true},
+		{action: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			got, err := ParseFailureAction(tt.action)
+			if (err != nil) != tt.err || got != tt.want {
+				t.Errorf("ParseFailureAction = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailabilityWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		connected   bool
+		want        bool
+		waited      bool
+	}{
+		{name: "no grace period", gracePeriod: 0, connected: true, want: false, waited: false},
+		{name: "reconnected", gracePeriod: time.Second, connected: true, want: true, waited: true},
+		{name: "grace period over", gracePeriod: time.Second, connected: false, want: false, waited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var waited time.Duration
+			availability := NewAvailability(tt.gracePeriod, 1, FailureActionClose, func(d time.Duration) bool {
+				waited = d
+				return tt.connected
+			})
+			if got := availability.wait(); got != tt.want {
+				t.Errorf("wait = %v, want %v", got, tt.want)
+			}
+			if (waited != 0) != tt.waited || tt.waited && waited != tt.gracePeriod {
+				t.Errorf("waited %s for the local component, want %v", waited, tt.waited)
+			}
+			if pending := availability.pending.Load(); pending != 0 {
+				t.Errorf("pending = %d after wait, want 0", pending)
+			}
+		})
+	}
+}
+
+func TestAvailabilityMaxPending(t *testing.T) {
+	release := make(chan struct{})
+	waiting := make(chan struct{})
+	availability := NewAvailability(time.Minute, 1, FailureActionClose, func(time.Duration) bool {
+		close(waiting)
+		<-release
+		return true
+	})
+	first := make(chan bool)
+	go func() { first <- availability.wait() }()
+	<-waiting
+	// the second connection is over the limit, so it is not held
+	if availability.wait() {
+		t.Error("wait = true over max pending, want false")
+	}
+	close(release)
+	if !<-first {
+		t.Error("wait = false for the held connection, want true")
+	}
+	if pending := availability.pending.Load(); pending != 0 {
+		t.Errorf("pending = %d after wait, want 0", pending)
+	}
+}
+
+// tcpPair returns both ends of a tcp connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestFailureActionTerminate(t *testing.T) {
+	tests := []struct {
+		action FailureAction
+		read   string
+		err    error
+	}{
+		{action: FailureActionClose, err: io.EOF},
+		{action: FailureActionReset, err: syscall.ECONNRESET},
+		{action: FailureActionHTTP, read: httpUnavailableResponse, err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.action), func(t *testing.T) {
+			client, server := tcpPair(t)
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			// a wrapped connection is terminated like the tcp connection it wraps
+			tt.action.terminate(newCountingConn(server, "8080/tcp"))
+			read, err := io.ReadAll(client)
+			if string(read) != tt.read {
+				t.Errorf("read %q, want %q", read, tt.read)
+			}
+			if err == nil {
+				err = io.EOF
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("read error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestServiceHoldsConnectionDuringGracePeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		want        string
+	}{
+		{name: "reconnected within grace period", gracePeriod: time.Second, want: "local"},
+		{name: "no grace period", gracePeriod: 0, want: httpUnavailableResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connected := false
+			openStream := func(commands.Command) (net.Conn, error) {
+				if !connected {
+					return nil, ErrClientNotConnected
+				}
+				local, remote := net.Pipe()
+				go func() {
+					remote.Write([]byte("local"))
+					remote.Close()
+				}()
+				return local, nil
+			}
+			availability := NewAvailability(tt.gracePeriod, 1, FailureActionHTTP, func(time.Duration) bool {
+				connected = true
+				return true
+			})
+			service := NewService("8080", openStream, availability, "", nil, MirrorOff)
+			client, server := net.Pipe()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go service.handleConnection(server)
+			read, _ := io.ReadAll(client)
+			if string(read) != tt.want {
+				t.Errorf("read %q, want %q", read, tt.want)
+			}
+		})
+	}
+}
@@ -2,30 +2,71 @@ package remote
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/mux"
+	"github.com/v4run/reversepf/version"
 )
 
+const handshakeTimeout = time.Second * 10
+
+var ErrClientNotConnected = errors.New("client not connected yet")
+
+// DialFailedError is returned when the local component is unable to connect to its target.
+type DialFailedError struct {
+	Reason string
+}
+
+func (e *DialFailedError) Error() string {
+	return "local component failed to connect: " + e.Reason
+}
+
 type ControlServer struct {
-	controlMessageConn     net.Conn
-	controlMessageConnLock *sync.RWMutex
-	messagesToLocal        chan []byte
-	messagesFromLocal      chan []byte
-	logger                 *log.Logger
-	Port                   string
+	session     *mux.Session
+	features    []string
+	clientReady chan struct{}
+	sessionLock *sync.RWMutex
+	// clientConnected is set once the first local component connects, to tell reconnects apart
+	clientConnected   bool
+	pendingConns      map[string]chan commands.Command
+	pendingConnsLock  *sync.Mutex
+	connCounter       *atomic.Uint64
+	messagesFromLocal chan []byte
+	ready             chan struct{}
+	logger            *log.Logger
+	Host              string
+	Port              string
+	ConnectTimeout    time.Duration
+	token             string
+	tlsConfig         *tls.Config
 }
 
 func (s *ControlServer) Start() {
-	listener, err := net.Listen("tcp", net.JoinHostPort("", s.Port))
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.Host, s.Port))
 	if err != nil {
 		s.logger.Fatal("Error starting listener", "err", err)
 	}
-	s.logger.Info("Ready to accept connection", "addr", listener.Addr().String())
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.logger.Info("Ready to accept connection", "addr", listener.Addr().String(), "tls", s.tlsConfig != nil)
+	close(s.ready)
+	if s.token == "" {
+		s.logger.Warn("No token configured. Any client can connect to the control server")
+	}
+	go s.handleMessagesFromLocal()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -33,70 +74,223 @@ func (s *ControlServer) Start() {
 			continue
 		}
 		s.logger.Info("Received new connection request", "addr", conn.RemoteAddr().String())
-		s.controlMessageConnLock.RLock()
-		if s.controlMessageConn == nil {
-			s.controlMessageConnLock.RUnlock()
-			s.controlMessageConnLock.Lock()
-			if s.controlMessageConn == nil {
-				s.controlMessageConn = conn
-				go s.handleControlMessages()
-			}
-			s.controlMessageConnLock.Unlock()
-			continue
-		}
-		s.controlMessageConnLock.RUnlock()
-		fmt.Fprintf(conn, "Client connection already established. Only one client can be connected at a time")
-		conn.Close()
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *ControlServer) handleConnection(conn net.Conn) {
+	session := mux.Server(conn)
+	reader := bufio.NewReader(session.Control())
+	features, err := s.handshake(session, reader)
+	if err != nil {
+		s.logger.Error("Handshake with local failed", "addr", conn.RemoteAddr().String(), "err", err)
+		session.Control().Write(commands.NewErrorCommand(err.Error()).Bytes())
+		session.Close()
+		return
 	}
+	s.sessionLock.Lock()
+	if s.session != nil {
+		s.sessionLock.Unlock()
+		session.Control().Write(commands.NewErrorCommand("Client connection already established. Only one client can be connected at a time").Bytes())
+		session.Close()
+		return
+	}
+	s.session = session
+	s.features = features
+	close(s.clientReady)
+	if s.clientConnected {
+		controlReconnects.With().Inc()
+	}
+	s.clientConnected = true
+	s.sessionLock.Unlock()
+	localClientConnected.With().Set(1)
+	s.handleControlMessages(session, reader)
 }
 
-func (s *ControlServer) handleControlMessages() {
+// handshake exchanges hello commands with the local component and returns the features both sides support.
+func (s *ControlServer) handshake(session *mux.Session, reader *bufio.Reader) ([]string, error) {
+	control := session.Control()
+	control.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hello, err := commands.ReadCommand(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hello: %w", err)
+	}
+	control.SetReadDeadline(time.Time{})
+	if hello.Type != commands.TypeHello {
+		return nil, fmt.Errorf("expected hello, received type %d", hello.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Token), []byte(s.token)) != 1 {
+		return nil, commands.ErrAuthenticationFailed
+	}
+	if _, err := control.Write(commands.NewHelloCommand(commands.SupportedFeatures, "").Bytes()); err != nil {
+		return nil, err
+	}
+	if hello.Protocol != commands.ProtocolVersion {
+		return nil, fmt.Errorf(
+			"incompatible protocol version. local %s uses protocol %d, remote %s uses protocol %d",
+			hello.Version, hello.Protocol, version.Version, commands.ProtocolVersion,
+		)
+	}
+	features := commands.CommonFeatures(commands.SupportedFeatures, hello.Features)
+	s.logger.Info("Handshake with local completed", "version", hello.Version, "protocol", hello.Protocol, "features", features)
+	return features, nil
+}
+
+func (s *ControlServer) handleControlMessages(session *mux.Session, reader *bufio.Reader) {
 	s.logger.Info("Control message handler started")
 	defer s.logger.Info("Control message handler terminated")
-	reader := bufio.NewReader(s.controlMessageConn)
-	killer := make(chan struct{})
-	go func() {
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				s.controlMessageConnLock.Lock()
-				s.controlMessageConn.Close()
-				s.controlMessageConn = nil
-				s.controlMessageConnLock.Unlock()
-				close(killer)
-			}
-			s.messagesFromLocal <- line
-		}
-	}()
 	for {
-		select {
-		case <-killer:
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		s.messagesFromLocal <- line
+	}
+	session.Close()
+	s.sessionLock.Lock()
+	if s.session == session {
+		s.session = nil
+		s.clientReady = make(chan struct{})
+		localClientConnected.With().Set(0)
+	}
+	s.sessionLock.Unlock()
+}
+
+// Ready is closed once the control server is listening.
+func (s *ControlServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// ClientConnected reports whether a local component is connected.
+func (s *ControlServer) ClientConnected() bool {
+	s.sessionLock.RLock()
+	defer s.sessionLock.RUnlock()
+	return s.session != nil
+}
+
+// WaitForClient waits for up to timeout for a local component to be connected.
+func (s *ControlServer) WaitForClient(timeout time.Duration) bool {
+	s.sessionLock.RLock()
+	connected, ready := s.session != nil, s.clientReady
+	s.sessionLock.RUnlock()
+	if connected {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// WaitForIdle blocks until no local component has been connected for the timeout. The time before the first
+// local component connects counts as idle too.
+func (s *ControlServer) WaitForIdle(timeout time.Duration) {
+	lastSeen := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.ClientConnected() {
+			lastSeen = time.Now()
+			continue
+		}
+		if time.Since(lastSeen) >= timeout {
 			return
-		case msg := <-s.messagesToLocal:
-			s.controlMessageConnLock.RLock()
-			s.controlMessageConn.Write(msg)
-			s.controlMessageConnLock.RUnlock()
 		}
 	}
 }
 
-func (s *ControlServer) SendMessage(command commands.Command) error {
-	s.controlMessageConnLock.RLock()
-	defer s.controlMessageConnLock.RUnlock()
-	if s.controlMessageConn == nil {
-		return errors.New("client not connected yet")
+func (s *ControlServer) handleMessagesFromLocal() {
+	for msg := range s.messagesFromLocal {
+		command, err := commands.ParseCommand(msg)
+		if err != nil {
+			s.logger.Warn("Invalid message from local", "err", err)
+			continue
+		}
+		switch command.Type {
+		case commands.TypeInitAck, commands.TypeDialFailed:
+			s.pendingConnsLock.Lock()
+			reply, ok := s.pendingConns[command.ID]
+			s.pendingConnsLock.Unlock()
+			if !ok {
+				s.logger.Warn("Received reply for unknown connection", "id", command.ID, "command", command)
+				continue
+			}
+			select {
+			case reply <- command:
+			default:
+			}
+		default:
+			s.logger.Warn("Unknown message from local", "command", command)
+		}
+	}
+}
+
+// OpenStream opens a new stream to the local component. The command is sent along with the stream
+// with a unique connection id, and the stream is returned once the local component acknowledges it.
+// A *DialFailedError is returned if the local component reports that it cannot connect to its target.
+func (s *ControlServer) OpenStream(command commands.Command) (net.Conn, error) {
+	s.sessionLock.RLock()
+	session, features := s.session, s.features
+	s.sessionLock.RUnlock()
+	if session == nil {
+		return nil, ErrClientNotConnected
+	}
+	if command.Network == mapping.ProtocolUDP && !slices.Contains(features, commands.FeatureUDP) {
+		return nil, errors.New("local component does not support udp")
+	}
+	command.ID = strconv.FormatUint(s.connCounter.Add(1), 10)
+	reply := make(chan commands.Command, 1)
+	s.pendingConnsLock.Lock()
+	s.pendingConns[command.ID] = reply
+	s.pendingConnsLock.Unlock()
+	defer func() {
+		s.pendingConnsLock.Lock()
+		delete(s.pendingConns, command.ID)
+		s.pendingConnsLock.Unlock()
+	}()
+	stream, err := session.Open(command.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(features, commands.FeatureInitAck) {
+		return stream, nil
+	}
+	timer := time.NewTimer(s.ConnectTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-reply:
+		if r.Type == commands.TypeDialFailed {
+			stream.Close()
+			return nil, &DialFailedError{Reason: r.Reason}
+		}
+		return stream, nil
+	case <-timer.C:
+		stream.Close()
+		return nil, fmt.Errorf("timed out waiting for local component to accept connection %s", command.ID)
+	case <-session.Done():
+		return nil, mux.ErrSessionClosed
 	}
-	s.messagesToLocal <- command.Bytes()
-	return nil
 }
 
-func NewControlServer(port string) ControlServer {
+func NewControlServer(host, port string, connectTimeout time.Duration, token string, tlsConfig *tls.Config) ControlServer {
 	return ControlServer{
-		controlMessageConn:     nil,
-		controlMessageConnLock: new(sync.RWMutex),
-		messagesToLocal:        make(chan []byte),
-		messagesFromLocal:      make(chan []byte),
-		logger:                 log.WithPrefix("[CTRLSRV]"),
-		Port:                   port,
+		session:           nil,
+		clientReady:       make(chan struct{}),
+		sessionLock:       new(sync.RWMutex),
+		pendingConns:      make(map[string]chan commands.Command),
+		pendingConnsLock:  new(sync.Mutex),
+		connCounter:       new(atomic.Uint64),
+		messagesFromLocal: make(chan []byte),
+		ready:             make(chan struct{}),
+		logger:            log.WithPrefix("[CTRLSRV]"),
+		Host:              host,
+		Port:              port,
+		ConnectTimeout:    connectTimeout,
+		token:             token,
+		tlsConfig:         tlsConfig,
 	}
 }
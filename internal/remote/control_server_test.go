@@ -0,0 +1,214 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/local"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/mux"
+)
+
+// closedPort returns a local address on which nothing listens.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestDialFailureReachesCaller(t *testing.T) {
+	_, port, err := net.SplitHostPort(closedPort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewControlServer("127.0.0.1", port, 5*time.Second, "token", nil)
+	go server.Start()
+	<-server.Ready()
+	m, err := mapping.Parse(closedPort(t) + ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := local.NewLocalComponent([]mapping.Mapping{m}, port, "token", nil, "", func(f func()) { go f() })
+	go client.Start()
+	if !server.WaitForClient(5 * time.Second) {
+		t.Fatal("local component did not connect")
+	}
+	start := time.Now()
+	_, err = server.OpenStream(commands.NewInitCommand("80", mapping.ProtocolTCP, "10.0.0.1:1234", "10.0.0.2:80"))
+	var dialFailed *DialFailedError
+	if !errors.As(err, &dialFailed) {
+		t.Fatalf("OpenStream = %v, want a dial failure", err)
+	}
+	if !strings.Contains(dialFailed.Reason, "refused") {
+		t.Errorf("reason = %q, want the connection to be refused", dialFailed.Reason)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failed after %s, want without waiting for the connect timeout", elapsed)
+	}
+}
+
+// handshakeWith runs the handshake of the control server with a local component sending the hello, and returns
+// the commands the control server answers with.
+func handshakeWith(t *testing.T, server *ControlServer, hello commands.Command) []commands.Command {
+	t.Helper()
+	_, replies := connectLocal(t, server, hello)
+	return replies
+}
+
+// connectLocal runs the handshake like handshakeWith, and also returns the session of the local component.
+func connectLocal(t *testing.T, server *ControlServer, hello commands.Command) (*mux.Session, []commands.Command) {
+	t.Helper()
+	a, b := net.Pipe()
+	session := mux.Client(a)
+	t.Cleanup(func() { session.Close() })
+	go server.handleConnection(b)
+	control := session.Control()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := control.Write(hello.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var replies []commands.Command
+	reader := bufio.NewReader(control)
+	for {
+		command, err := commands.ReadCommand(reader)
+		if err != nil {
+			return session, replies
+		}
+		replies = append(replies, command)
+		if command.Type == commands.TypeError {
+			return session, replies
+		}
+		if command.Type == commands.TypeHello && hello.Protocol == commands.ProtocolVersion {
+			control.SetDeadline(time.Time{})
+			return session, replies
+		}
+	}
+}
+
+func TestHandshakeIncompatibleVersion(t *testing.T) {
+	server := NewControlServer("127.0.0.1", "0", time.Second, "", nil)
+	hello := commands.NewHelloCommand(commands.SupportedFeatures, "")
+	hello.Protocol = commands.ProtocolVersion + 1
+	replies := handshakeWith(t, &server, hello)
+	// the hello is answered first, so that the local component can report the versions
+	if len(replies) != 2 || replies[0].Type != commands.TypeHello || replies[1].Type != commands.TypeError {
+		t.Fatalf("replies = %v, want a hello and an error", replies)
+	}
+	if replies[0].Protocol != commands.ProtocolVersion {
+		t.Errorf("protocol = %d, want %d", replies[0].Protocol, commands.ProtocolVersion)
+	}
+	if !strings.Contains(replies[1].Reason, "incompatible protocol version") {
+		t.Errorf("reason = %q, want the incompatible protocol version", replies[1].Reason)
+	}
+	if server.ClientConnected() {
+		t.Error("local component connected, want it rejected")
+	}
+}
+
+func TestHandshakeNegotiatesFeatures(t *testing.T) {
+	server := NewControlServer("127.0.0.1", "0", time.Second, "", nil)
+	replies := handshakeWith(t, &server, commands.NewHelloCommand([]string{commands.FeatureUDP, "unknown"}, ""))
+	if len(replies) != 1 || replies[0].Type != commands.TypeHello {
+		t.Fatalf("replies = %v, want a hello", replies)
+	}
+	if !server.WaitForClient(time.Second) {
+		t.Fatal("local component not connected")
+	}
+	server.sessionLock.RLock()
+	features := server.features
+	server.sessionLock.RUnlock()
+	if len(features) != 1 || features[0] != commands.FeatureUDP {
+		t.Errorf("features = %v, want [%s]", features, commands.FeatureUDP)
+	}
+}
+
+func TestHandshakeToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  commands.CommandType
+	}{
+		{name: "matching token", token: "token", want: commands.TypeHello},
+		{name: "wrong token", token: "other", want: commands.TypeError},
+		{name: "missing token", token: "", want: commands.TypeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewControlServer("127.0.0.1", "0", time.Second, "token", nil)
+			replies := handshakeWith(t, &server, commands.NewHelloCommand(commands.SupportedFeatures, tt.token))
+			if len(replies) != 1 || replies[0].Type != tt.want {
+				t.Fatalf("replies = %v, want one of type %d", replies, tt.want)
+			}
+			if tt.want == commands.TypeError && replies[0].Reason != commands.ErrAuthenticationFailed.Error() {
+				t.Errorf("reason = %q, want %q", replies[0].Reason, commands.ErrAuthenticationFailed)
+			}
+			if connected := server.WaitForClient(100 * time.Millisecond); connected != (tt.want == commands.TypeHello) {
+				t.Errorf("connected = %v, want %v", connected, tt.want == commands.TypeHello)
+			}
+		})
+	}
+}
+
+func TestWrongTokenStopsLocal(t *testing.T) {
+	_, port, err := net.SplitHostPort(closedPort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewControlServer("127.0.0.1", port, time.Second, "token", nil)
+	go server.Start()
+	<-server.Ready()
+	client := local.NewLocalComponent(nil, port, "other", nil, "", func(f func()) { go f() })
+	done := make(chan error, 1)
+	go func() { done <- client.Start() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, local.ErrUnauthorized) {
+			t.Errorf("Start = %v, want %v", err, local.ErrUnauthorized)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("local component still retrying with a rejected token")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	server := NewControlServer("127.0.0.1", "0", 100*time.Millisecond, "", nil)
+	// the local component accepts the stream but never acknowledges it
+	session, _ := connectLocal(t, &server, commands.NewHelloCommand(commands.SupportedFeatures, ""))
+	if !server.WaitForClient(time.Second) {
+		t.Fatal("local component not connected")
+	}
+	availability := NewAvailability(0, 0, FailureActionReset, server.WaitForClient)
+	service := NewService("8080", server.OpenStream, availability, "", nil, MirrorOff)
+	client, conn := tcpPair(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	go service.handleConnection(conn)
+
+	stream, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read from the unacknowledged stream = %v, want it closed", err)
+	}
+	if _, err := io.ReadAll(client); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("read from the client connection = %v, want it reset", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("reset after %s, want after the connect timeout", elapsed)
+	}
+}
@@ -0,0 +1,95 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/version"
+)
+
+// Status is served at /status, for the local side to tell whether a local component is attached.
+type Status struct {
+	Version         string `json:"version"`
+	Ready           bool   `json:"ready"`
+	Reason          string `json:"reason,omitempty"`
+	ClientConnected bool   `json:"clientConnected"`
+}
+
+// HealthServer serves the liveness and readiness of the remote component for kubernetes probes, and its status.
+type HealthServer struct {
+	listeners       []<-chan struct{}
+	clientConnected func() bool
+	logger          *log.Logger
+	Port            string
+	// RequireClient makes the remote component ready only while a local component is connected
+	RequireClient bool
+}
+
+// handler serves /healthz, /readyz and /status.
+func (s *HealthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if reason := s.notReadyReason(); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		reason := s.notReadyReason()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status{
+			Version:         version.Version,
+			Ready:           reason == "",
+			Reason:          reason,
+			ClientConnected: s.clientConnected(),
+		})
+	})
+	return mux
+}
+
+func (s *HealthServer) Start() {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", s.Port))
+	if err != nil {
+		s.logger.Fatal("Error starting listener", "err", err)
+	}
+	s.logger.Info("Ready to serve health checks", "addr", listener.Addr().String())
+	if err := http.Serve(listener, s.handler()); err != nil {
+		s.logger.Fatal("Error serving health checks", "err", err)
+	}
+}
+
+// notReadyReason returns why the remote component is not ready yet, or an empty string if it is ready.
+func (s *HealthServer) notReadyReason() string {
+	for _, ready := range s.listeners {
+		select {
+		case <-ready:
+		default:
+			return "listeners not ready"
+		}
+	}
+	if s.RequireClient && !s.clientConnected() {
+		return "local component not connected"
+	}
+	return ""
+}
+
+// NewHealthServer returns a health server which is ready once all the listeners are ready.
+func NewHealthServer(port string, listeners []<-chan struct{}, clientConnected func() bool, requireClient bool) HealthServer {
+	if clientConnected == nil {
+		log.Fatal("Error create new health server. `clientConnected` is nil")
+	}
+	return HealthServer{
+		listeners:       listeners,
+		clientConnected: clientConnected,
+		logger:          log.WithPrefix("[HEALTH]"),
+		Port:            port,
+		RequireClient:   requireClient,
+	}
+}
@@ -0,0 +1,93 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// healthServer returns a health server whose listeners are ready if listenersReady, with the local component
+// connected if connected.
+func healthServer(listenersReady, connected, requireClient bool) *HealthServer {
+	ready, pending := make(chan struct{}), make(chan struct{})
+	close(ready)
+	listeners := []<-chan struct{}{ready}
+	if !listenersReady {
+		listeners = append(listeners, pending)
+	}
+	server := NewHealthServer("0", listeners, func() bool { return connected }, requireClient)
+	return &server
+}
+
+// get serves the request for the path and returns the response code and body.
+func get(server *HealthServer, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	server.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, strings.TrimSpace(recorder.Body.String())
+}
+
+func TestHealthz(t *testing.T) {
+	// the remote component is alive even before its listeners are ready
+	code, body := get(healthServer(false, false, true), "/healthz")
+	if code != http.StatusOK || body != "ok" {
+		t.Errorf("/healthz = %d %q, want %d ok", code, body, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name           string
+		listenersReady bool
+		connected      bool
+		requireClient  bool
+		code           int
+		body           string
+	}{
+		{name: "ready", listenersReady: true, code: http.StatusOK, body: "ok"},
+		{name: "listeners not ready", listenersReady: false, connected: true, code: http.StatusServiceUnavailable, body: "listeners not ready"},
+		{name: "client required and connected", listenersReady: true, connected: true, requireClient: true, code: http.StatusOK, body: "ok"},
+		{name: "client required and not connected", listenersReady: true, requireClient: true, code: http.StatusServiceUnavailable, body: "local component not connected"},
+		{name: "listeners before client", listenersReady: false, requireClient: true, code: http.StatusServiceUnavailable, body: "listeners not ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := get(healthServer(tt.listenersReady, tt.connected, tt.requireClient), "/readyz")
+			if code != tt.code || body != tt.body {
+				t.Errorf("/readyz = %d %q, want %d %q", code, body, tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		listenersReady bool
+		connected      bool
+		requireClient  bool
+		want           Status
+	}{
+		{name: "attached", listenersReady: true, connected: true, want: Status{Ready: true, ClientConnected: true}},
+		{name: "detached", listenersReady: true, want: Status{Ready: true}},
+		{name: "detached and client required", listenersReady: true, requireClient: true, want: Status{Reason: "local component not connected"}},
+		{name: "starting", connected: true, want: Status{Reason: "listeners not ready", ClientConnected: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := get(healthServer(tt.listenersReady, tt.connected, tt.requireClient), "/status")
+			if code != http.StatusOK {
+				t.Fatalf("/status = %d, want %d", code, http.StatusOK)
+			}
+			var status Status
+			if err := json.Unmarshal([]byte(body), &status); err != nil {
+				t.Fatal(err)
+			}
+			status.Version = ""
+			if status != tt.want {
+				t.Errorf("/status = %+v, want %+v", status, tt.want)
+			}
+		})
+	}
+}
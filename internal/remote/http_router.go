@@ -0,0 +1,203 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/proxy"
+)
+
+// Route selects the http requests which are sent to the local component, by the value of a header.
+type Route struct {
+	Header string
+	Value  string
+}
+
+// ParseRoute parses a route of the form HEADER=VALUE.
+func ParseRoute(spec string) (*Route, error) {
+	header, value, found := strings.Cut(spec, "=")
+	header = strings.TrimSpace(header)
+	if !found || header == "" {
+		return nil, fmt.Errorf("invalid route %q. Must be of the form HEADER=VALUE", spec)
+	}
+	return &Route{Header: http.CanonicalHeaderKey(header), Value: strings.TrimSpace(value)}, nil
+}
+
+func (r *Route) String() string {
+	return r.Header + "=" + r.Value
+}
+
+func (r *Route) matches(req *http.Request) bool {
+	for _, v := range req.Header.Values(r.Header) {
+		if v == r.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// backend is a connection to which requests of a client connection are forwarded. It is reused for
+// the following requests going to the same place, as long as both the sides keep the connection alive.
+type backend struct {
+	name   string
+	conn   net.Conn
+	reader *bufio.Reader
+	reused bool
+}
+
+func newBackend(name string, conn net.Conn) *backend {
+	return &backend{name: name, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (b *backend) close() {
+	if b != nil {
+		b.conn.Close()
+	}
+}
+
+// bufferedConn reads through a reader which may already hold data read from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c bufferedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+// routeHTTP reads the connection as a series of http requests and routes each request on its own, so that
+// the requests of a keep-alive connection can go to different places. Requests matching the route are sent
+// to the local component and the rest to the upstream.
+func (s *Service) routeHTTP(conn net.Conn) {
+	defer conn.Close()
+	clientAddr := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	var local, upstream *backend
+	defer func() {
+		local.close()
+		upstream.close()
+	}()
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Warn("Error reading http request", "addr", clientAddr, "err", err)
+			}
+			return
+		}
+		var b *backend
+		if s.Route.matches(req) {
+			if local == nil {
+				if local, err = s.dialLocal(conn); err != nil {
+					countDialFailure(s.Port+"/"+mapping.ProtocolTCP, err)
+					s.logger.Warn("Unable to send matching request to local component. Using upstream", "addr", clientAddr, "err", err)
+				}
+			}
+			b = local
+		}
+		if b == nil {
+			if upstream == nil {
+				if upstream, err = s.dialUpstream(); err != nil {
+					s.logger.Error("Error connecting to upstream", "upstream", s.Upstream, "err", err, "action", s.availability.OnFailure)
+					s.availability.OnFailure.terminate(conn)
+					return
+				}
+			}
+			b = upstream
+		}
+		s.logger.Debug("Routing request", "addr", clientAddr, "method", req.Method, "uri", req.RequestURI, "to", b.name)
+		keepAlive, upgraded, err := s.forwardRequest(req, b, conn)
+		if upgraded {
+			s.proxyData(bufferedConn{Conn: conn, reader: reader}, bufferedConn{Conn: b.conn, reader: b.reader})
+			return
+		}
+		if err != nil {
+			s.logger.Warn("Error forwarding http request", "addr", clientAddr, "to", b.name, "err", err)
+			return
+		}
+		if !keepAlive {
+			return
+		}
+		b.reused = true
+	}
+}
+
+// forwardRequest writes the request to the backend and copies the response back to the client. A request
+// without a body is retried once on a new connection if a reused connection turns out to be closed.
+func (s *Service) forwardRequest(req *http.Request, b *backend, client net.Conn) (keepAlive, upgraded bool, err error) {
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// stops Request.Write from adding its own user agent
+		req.Header.Set("User-Agent", "")
+	}
+	resp, err := roundTrip(req, b)
+	if err != nil && b.reused && req.Body == http.NoBody {
+		b.conn.Close()
+		var conn net.Conn
+		if b.name == "local" {
+			conn, err = s.openLocalStream(client)
+		} else {
+			conn, err = net.Dial("tcp", s.Upstream)
+		}
+		if err != nil {
+			return false, false, err
+		}
+		*b = *newBackend(b.name, conn)
+		resp, err = roundTrip(req, b)
+	}
+	for err == nil {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return false, true, resp.Write(client)
+		}
+		err = resp.Write(client)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode >= http.StatusOK {
+			break
+		}
+		// informational responses are followed by the final response
+		resp, err = http.ReadResponse(b.reader, req)
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return !req.Close && !resp.Close, false, nil
+}
+
+func roundTrip(req *http.Request, b *backend) (*http.Response, error) {
+	if err := req.Write(b.conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(b.reader, req)
+}
+
+func (s *Service) dialLocal(client net.Conn) (*backend, error) {
+	stream, err := s.openLocalStream(client)
+	if err != nil {
+		return nil, err
+	}
+	return newBackend("local", stream), nil
+}
+
+// openLocalStream opens a stream to the local component. Routed requests always have an upstream, so they are
+// not held until the local component reconnects.
+func (s *Service) openLocalStream(client net.Conn) (net.Conn, error) {
+	return s.openStream(commands.NewInitCommand(s.Port, mapping.ProtocolTCP, client.RemoteAddr().String(), client.LocalAddr().String()))
+}
+
+func (s *Service) dialUpstream() (*backend, error) {
+	conn, err := net.Dial("tcp", s.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	return newBackend("upstream", conn), nil
+}
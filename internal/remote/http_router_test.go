@@ -0,0 +1,176 @@
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+)
+
+// backendServer answers every request with its name and the path of the request, and counts the connections
+// it accepts.
+func backendServer(t *testing.T, name string) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	connections := new(atomic.Int64)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, connections
+}
+
+// routingService returns a service routing the requests with the header "X-Dev: alice" to the local server,
+// which stands in for the local component, and the rest to the upstream server.
+func routingService(t *testing.T, local, upstream *httptest.Server) *Service {
+	t.Helper()
+	openStream := func(commands.Command) (net.Conn, error) {
+		return net.Dial("tcp", local.Listener.Addr().String())
+	}
+	availability := NewAvailability(0, 0, FailureActionClose, func(time.Duration) bool { return false })
+	route, err := ParseRoute("x-dev=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewService("8080", openStream, availability, upstream.Listener.Addr().String(), route, MirrorOff)
+	return &service
+}
+
+func TestRouteHTTPPerRequest(t *testing.T) {
+	local, localConnections := backendServer(t, "local")
+	upstream, upstreamConnections := backendServer(t, "upstream")
+	service := routingService(t, local, upstream)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		service.routeHTTP(server)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	requests := []struct {
+		path    string
+		matches bool
+	}{
+		{"/a", true},
+		{"/b", false},
+		{"/c", false},
+		{"/d", true},
+		{"/e", false},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequest(http.MethodGet, "http://service"+r.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "upstream " + r.path
+		if r.matches {
+			req.Header.Set("X-Dev", "alice")
+			want = "local " + r.path
+		} else {
+			req.Header.Set("X-Dev", "bob")
+		}
+		if err := req.Write(client); err != nil {
+			t.Fatalf("writing request %s: %v", r.path, err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("reading response to %s: %v", r.path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("reading response body to %s: %v", r.path, err)
+		}
+		if string(body) != want {
+			t.Errorf("response to %s = %q, want %q", r.path, body, want)
+		}
+		if resp.Close {
+			t.Fatalf("connection closed after %s", r.path)
+		}
+	}
+	client.Close()
+	<-done
+	// the connection to each backend is kept alive across the requests
+	if n := localConnections.Load(); n != 1 {
+		t.Errorf("local server accepted %d connections, want 1", n)
+	}
+	if n := upstreamConnections.Load(); n != 1 {
+		t.Errorf("upstream server accepted %d connections, want 1", n)
+	}
+}
+
+func TestRouteHTTPConnectionClose(t *testing.T) {
+	local, _ := backendServer(t, "local")
+	upstream, _ := backendServer(t, "upstream")
+	service := routingService(t, local, upstream)
+	client, server := net.Pipe()
+	go service.routeHTTP(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(client, "GET /last HTTP/1.1\r\nHost: service\r\nX-Dev: alice\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client connection is closed once the response is sent
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(response), "local /last") {
+		t.Errorf("response = %q, want one from the local server", response)
+	}
+}
+
+func TestRouteHTTPNotConnectedUsesUpstream(t *testing.T) {
+	upstream, _ := backendServer(t, "upstream")
+	openStream := func(commands.Command) (net.Conn, error) {
+		return nil, ErrClientNotConnected
+	}
+	availability := NewAvailability(time.Minute, 1, FailureActionClose, func(time.Duration) bool {
+		t.Error("request held for the local component")
+		return false
+	})
+	route, err := ParseRoute("x-dev=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewService("8080", openStream, availability, upstream.Listener.Addr().String(), route, MirrorOff)
+	client, server := net.Pipe()
+	go service.routeHTTP(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	// every matching request of the keep-alive connection falls back to the upstream without waiting
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.NewRequest(http.MethodGet, "http://service"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Dev", "alice")
+		if err := req.Write(client); err != nil {
+			t.Fatalf("writing request %s: %v", path, err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("reading response to %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "upstream " + path; string(body) != want {
+			t.Errorf("response to %s = %q, want %q", path, body, want)
+		}
+	}
+	client.Close()
+}
@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/metrics"
+	"github.com/v4run/reversepf/internal/proxy"
+)
+
+var (
+	activeConnections = metrics.Default.Gauge(
+		"reversepf_connections_active", "Number of connections, or udp flows, currently open.", "port",
+	)
+	totalConnections = metrics.Default.Counter(
+		"reversepf_connections_total", "Number of connections, or udp flows, accepted.", "port",
+	)
+	transferredBytes = metrics.Default.Counter(
+		"reversepf_transferred_bytes_total", "Bytes transferred. Direction in is from the clients, out is to the clients.", "port", "direction",
+	)
+	connectionDuration = metrics.Default.Histogram(
+		"reversepf_connection_duration_seconds", "Duration of connections, or udp flows.",
+		[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}, "port",
+	)
+	dialFailures = metrics.Default.Counter(
+		"reversepf_dial_failures_total", "Connections which could not be proxied to the local component. Reason unavailable is for a disconnected local component, target for a local target which refused the connection.", "port", "reason",
+	)
+	localClientConnected = metrics.Default.Gauge(
+		"reversepf_local_client_connected", "Whether the local component is connected.",
+	)
+	controlReconnects = metrics.Default.Counter(
+		"reversepf_control_reconnects_total", "Number of times the local component connected again after the first connection.",
+	)
+)
+
+// countDialFailure records why a stream to the local component could not be opened.
+func countDialFailure(port string, err error) {
+	var dialErr *DialFailedError
+	reason := "error"
+	switch {
+	case errors.As(err, &dialErr):
+		reason = "target"
+	case errors.Is(err, ErrClientNotConnected):
+		reason = "unavailable"
+	}
+	dialFailures.With(port, reason).Inc()
+}
+
+// countingConn counts the bytes read from and written to a client connection.
+type countingConn struct {
+	net.Conn
+	in  *metrics.Counter
+	out *metrics.Counter
+}
+
+func newCountingConn(conn net.Conn, port string) countingConn {
+	return countingConn{
+		Conn: conn,
+		in:   transferredBytes.With(port, "in"),
+		out:  transferredBytes.With(port, "out"),
+	}
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(uint64(n))
+	return n, err
+}
+
+func (c countingConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+func (c countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// MetricsServer exposes the metrics of the remote component for prometheus.
+type MetricsServer struct {
+	logger *log.Logger
+	Port   string
+}
+
+func (s *MetricsServer) Start() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	listener, err := net.Listen("tcp", net.JoinHostPort("", s.Port))
+	if err != nil {
+		s.logger.Fatal("Error starting listener", "err", err)
+	}
+	s.logger.Info("Ready to serve metrics", "addr", listener.Addr().String())
+	if err := http.Serve(listener, mux); err != nil {
+		s.logger.Fatal("Error serving metrics", "err", err)
+	}
+}
+
+func NewMetricsServer(port string) MetricsServer {
+	return MetricsServer{
+		logger: log.WithPrefix("[METRICS]"),
+		Port:   port,
+	}
+}
@@ -0,0 +1,162 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/proxy"
+)
+
+// MirrorMode decides what is copied to the local component while connections are served by the upstream.
+type MirrorMode string
+
+const (
+	// MirrorOff proxies connections to the local component as usual
+	MirrorOff MirrorMode = "off"
+	// MirrorRequests copies the bytes sent by the client
+	MirrorRequests MirrorMode = "requests"
+	// MirrorAll also copies the bytes sent by the upstream, over a second connection to the local target. The
+	// target cannot tell the two connections apart, so it must be a sink which only records what it receives,
+	// like a capture tool. A server would read the responses as requests
+	MirrorAll MirrorMode = "all"
+)
+
+const (
+	// mirrorBufferSize is the number of bytes queued for the local component before a mirror gives up
+	mirrorBufferSize = 4 << 20
+	// mirrorQueueSize is the number of reads queued for the local component before a mirror gives up
+	mirrorQueueSize = 1024
+)
+
+func ParseMirrorMode(mode string) (MirrorMode, error) {
+	switch m := MirrorMode(mode); m {
+	case MirrorOff, MirrorRequests, MirrorAll:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown mirror mode %q. Must be one of off, requests or all", mode)
+	}
+}
+
+// mirrorConnection sends the connection to the upstream and copies its traffic to the local component.
+// Whatever the local component answers is discarded.
+func (s *Service) mirrorConnection(conn net.Conn) {
+	upstreamConn, err := net.Dial("tcp", s.Upstream)
+	if err != nil {
+		s.logger.Error("Error connecting to upstream", "upstream", s.Upstream, "err", err, "action", s.availability.OnFailure)
+		s.availability.OnFailure.terminate(conn)
+		return
+	}
+	client := teeConn{Conn: conn, mirror: s.newMirror(conn)}
+	var upstream net.Conn = upstreamConn
+	if s.Mirror == MirrorAll {
+		upstream = teeConn{Conn: upstreamConn, mirror: s.newMirror(conn)}
+	}
+	s.logger.Info("Mirroring connection", "addr", conn.RemoteAddr().String(), "upstream", s.Upstream, "mode", s.Mirror)
+	s.proxyData(client, upstream)
+}
+
+// mirror is a best effort copy of one direction of a connection to the local component. Reads are queued
+// without blocking and the mirror gives up as soon as the queue is full, so that a slow or disconnected
+// local component never slows down the mirrored connection.
+type mirror struct {
+	chunks  chan []byte
+	queued  *atomic.Int64
+	stopped *atomic.Bool
+	closed  bool
+	logger  *log.Logger
+}
+
+func (s *Service) newMirror(client net.Conn) *mirror {
+	m := &mirror{
+		chunks:  make(chan []byte, mirrorQueueSize),
+		queued:  new(atomic.Int64),
+		stopped: new(atomic.Bool),
+		logger:  s.logger.With("addr", client.RemoteAddr().String()),
+	}
+	go m.run(s.openStream, commands.NewInitCommand(s.Port, mapping.ProtocolTCP, client.RemoteAddr().String(), client.LocalAddr().String()))
+	return m
+}
+
+// write queues a copy of b. It must not be called concurrently with itself or close.
+func (m *mirror) write(b []byte) {
+	if m.closed {
+		return
+	}
+	if m.stopped.Load() {
+		m.close()
+		return
+	}
+	if m.queued.Add(int64(len(b))) <= mirrorBufferSize {
+		select {
+		case m.chunks <- bytes.Clone(b):
+			return
+		default:
+		}
+	}
+	m.logger.Warn("Local component is too slow. Mirroring stopped for the connection")
+	m.stopped.Store(true)
+	m.close()
+}
+
+func (m *mirror) close() {
+	if !m.closed {
+		m.closed = true
+		close(m.chunks)
+	}
+}
+
+func (m *mirror) run(openStream func(commands.Command) (net.Conn, error), command commands.Command) {
+	stream, err := openStream(command)
+	if err != nil {
+		m.logger.Debug("Not mirroring connection", "err", err)
+		m.discard()
+		return
+	}
+	defer stream.Close()
+	go io.Copy(io.Discard, stream)
+	for chunk := range m.chunks {
+		m.queued.Add(-int64(len(chunk)))
+		if _, err := stream.Write(chunk); err != nil {
+			m.logger.Debug("Error mirroring connection", "err", err)
+			m.discard()
+			return
+		}
+	}
+	if !m.stopped.Load() {
+		proxy.CloseWrite(stream)
+	}
+}
+
+// discard stops the mirror and drops everything queued.
+func (m *mirror) discard() {
+	m.stopped.Store(true)
+	for range m.chunks {
+	}
+}
+
+// teeConn copies everything read from the connection to a mirror.
+type teeConn struct {
+	net.Conn
+	mirror *mirror
+}
+
+func (c teeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mirror.write(b[:n])
+	}
+	if err != nil {
+		c.mirror.close()
+	}
+	return n, err
+}
+
+func (c teeConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
@@ -0,0 +1,138 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+)
+
+// mirrorService returns a service mirroring connections to the upstream, and opening streams to the local
+// component with openStream.
+func mirrorService(t *testing.T, upstream string, mode MirrorMode, openStream func(commands.Command) (net.Conn, error)) *Service {
+	t.Helper()
+	availability := NewAvailability(0, 0, FailureActionClose, func(time.Duration) bool { return false })
+	service := NewService("8080", openStream, availability, upstream, nil, mode)
+	return &service
+}
+
+func TestMirrorDropsWhenBufferIsFull(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{name: "queue full", chunks: bytes.Fields(bytes.Repeat([]byte("a "), mirrorQueueSize+1))},
+		{name: "buffer full", chunks: [][]byte{make([]byte, mirrorBufferSize/2), make([]byte, mirrorBufferSize/2+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the local component never takes what is queued
+			release := make(chan struct{})
+			defer close(release)
+			service := mirrorService(t, "upstream:80", MirrorRequests, func(commands.Command) (net.Conn, error) {
+				<-release
+				return nil, errors.New("local component gone")
+			})
+			client, _ := net.Pipe()
+			m := service.newMirror(client)
+			last := len(tt.chunks) - 1
+			for _, chunk := range tt.chunks[:last] {
+				m.write(chunk)
+			}
+			if m.stopped.Load() {
+				t.Fatal("mirror stopped before the buffer is full")
+			}
+			m.write(tt.chunks[last])
+			if !m.stopped.Load() || !m.closed {
+				t.Fatal("mirror still running with a full buffer")
+			}
+			// writes after the mirror stopped are dropped
+			m.write([]byte("dropped"))
+		})
+	}
+}
+
+// sinkUpstream reads every connection to the end and answers with the number of bytes read.
+func sinkUpstream(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(io.Discard, conn)
+				fmt.Fprint(conn, n)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	mirrored := make(chan []byte, 1)
+	service := mirrorService(t, sinkUpstream(t), MirrorRequests, func(commands.Command) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			b, _ := io.ReadAll(remote)
+			remote.Close()
+			mirrored <- b
+		}()
+		return local, nil
+	})
+	client, server := tcpPair(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go service.handleConnection(server)
+	go func() {
+		client.Write([]byte("request"))
+		client.CloseWrite()
+	}()
+	answer, _ := io.ReadAll(client)
+	if string(answer) != "7" {
+		t.Errorf("upstream answered %q, want 7", answer)
+	}
+	select {
+	case b := <-mirrored:
+		if string(b) != "request" {
+			t.Errorf("mirrored %q, want %q", b, "request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing mirrored to the local component")
+	}
+}
+
+func TestMirrorDoesNotSlowDownConnection(t *testing.T) {
+	// the local component accepts the stream but never reads from it
+	service := mirrorService(t, sinkUpstream(t), MirrorRequests, func(commands.Command) (net.Conn, error) {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	})
+	client, server := tcpPair(t)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	go service.handleConnection(server)
+	size := 2*mirrorBufferSize + 1
+	go func() {
+		client.Write(make([]byte, size))
+		client.CloseWrite()
+	}()
+	answer, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(answer) != fmt.Sprint(size) {
+		t.Errorf("upstream read %s bytes, want %d", answer, size)
+	}
+}
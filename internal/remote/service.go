@@ -1,19 +1,37 @@
 package remote
 
 import (
-	"fmt"
-	"io"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/proxy"
+	"github.com/v4run/reversepf/internal/proxyproto"
 )
 
+// proxyHeaderTimeout is how long a connection has to send its PROXY protocol header
+const proxyHeaderTimeout = time.Second * 10
+
 type Service struct {
-	getLocalConn   func() net.Conn
-	sendControlMsg func(commands.Command) error
-	logger         *log.Logger
-	Port           string
+	openStream   func(commands.Command) (net.Conn, error)
+	availability *Availability
+	ready        chan struct{}
+	logger       *log.Logger
+	Port         string
+	// Upstream is the address connections are sent to when they cannot be proxied to the local component
+	Upstream string
+	// Route, if set, makes the service route every http request on its own. Only the requests matching
+	// it are sent to the local component, the rest go to the upstream.
+	Route *Route
+	// Mirror, unless off, makes the service send every connection to the upstream and only copy its traffic
+	// to the local component
+	Mirror MirrorMode
+	// AcceptProxyProtocol makes the service expect a PROXY protocol header on every connection. The client
+	// address from the header is the one reported to the local component.
+	AcceptProxyProtocol bool
 }
 
 func (s *Service) Start() {
@@ -22,6 +40,7 @@ func (s *Service) Start() {
 		s.logger.Fatal("Error starting listner", "err", err)
 	}
 	s.logger.Info("Ready to accept connections", "addr", listner.Addr().String())
+	close(s.ready)
 	for {
 		conn, err := listner.Accept()
 		if err != nil {
@@ -29,44 +48,118 @@ func (s *Service) Start() {
 			continue
 		}
 		s.logger.Info("Received new connection request", "addr", conn.RemoteAddr().String())
-		if err := s.sendControlMsg(commands.NewInitCommand()); err != nil {
-			s.logger.Error("Error sending control message", "err", err)
-			fmt.Fprintf(conn, "Local component not ready. Please retry.")
+		go s.handleConnection(conn)
+	}
+}
+
+// Ready is closed once the service is listening.
+func (s *Service) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Service) handleConnection(conn net.Conn) {
+	label := s.Port + "/" + mapping.ProtocolTCP
+	totalConnections.With(label).Inc()
+	active := activeConnections.With(label)
+	active.Inc()
+	start := time.Now()
+	defer func() {
+		active.Dec()
+		connectionDuration.With(label).Observe(time.Since(start).Seconds())
+	}()
+	conn = newCountingConn(conn, label)
+	if s.AcceptProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		proxyConn, err := proxyproto.NewConn(conn)
+		if err != nil {
+			s.logger.Warn("Invalid proxy protocol header", "addr", conn.RemoteAddr().String(), "err", err)
 			conn.Close()
-			continue
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn = proxyConn
+	}
+	if s.Route != nil {
+		s.routeHTTP(conn)
+		return
+	}
+	if s.Mirror != MirrorOff {
+		s.mirrorConnection(conn)
+		return
+	}
+	command := commands.NewInitCommand(s.Port, mapping.ProtocolTCP, conn.RemoteAddr().String(), conn.LocalAddr().String())
+	stream, err := s.openStream(command)
+	// With an upstream, there is no need to hold the connection until the local component reconnects
+	if errors.Is(err, ErrClientNotConnected) && s.Upstream == "" && s.availability.wait() {
+		stream, err = s.openStream(command)
+	}
+	if err != nil {
+		countDialFailure(label, err)
+		var dialErr *DialFailedError
+		if errors.As(err, &dialErr) {
+			s.logger.Error("Local component could not connect to its target", "addr", conn.RemoteAddr().String(), "reason", dialErr.Reason)
+		} else {
+			s.logger.Error("Error opening stream to local component", "addr", conn.RemoteAddr().String(), "err", err)
 		}
-		go s.proxyData(conn, s.getLocalConn())
+		s.fallback(conn)
+		return
+	}
+	s.proxyData(conn, stream)
+}
+
+// fallback sends the connection to the upstream if there is one. Otherwise the connection is terminated.
+func (s *Service) fallback(conn net.Conn) {
+	if s.Upstream == "" {
+		s.logger.Info("Terminating connection", "addr", conn.RemoteAddr().String(), "action", s.availability.OnFailure)
+		s.availability.OnFailure.terminate(conn)
+		return
+	}
+	upstreamConn, err := net.Dial("tcp", s.Upstream)
+	if err != nil {
+		s.logger.Error("Error connecting to upstream", "upstream", s.Upstream, "err", err, "action", s.availability.OnFailure)
+		s.availability.OnFailure.terminate(conn)
+		return
 	}
+	s.logger.Info("Sending connection to upstream", "addr", conn.RemoteAddr().String(), "upstream", s.Upstream)
+	s.proxyData(conn, upstreamConn)
 }
 
-func (s *Service) proxyData(conn, portalConn net.Conn) {
+func (s *Service) proxyData(conn, stream net.Conn) {
 	serviceAddr := conn.RemoteAddr().String()
-	portalAddr := portalConn.RemoteAddr().String()
-	s.logger.Info("New proxy established", "serviceAddr", serviceAddr, "portalAddr", portalAddr)
-	defer conn.Close()
-	go func() {
-		defer portalConn.Close()
-		if _, err := io.Copy(portalConn, conn); err != nil {
-			s.logger.Warn("Connection closed", "err", err)
-		}
-	}()
-	if _, err := io.Copy(conn, portalConn); err != nil {
+	s.logger.Info("New proxy established", "serviceAddr", serviceAddr)
+	if err := proxy.Pipe(conn, stream); err != nil {
 		s.logger.Warn("Connection closed", "err", err)
 	}
-	s.logger.Info("Stopping proxy", "serviceAddr", serviceAddr, "portalAddr", portalAddr)
+	s.logger.Info("Stopping proxy", "serviceAddr", serviceAddr)
 }
 
-func NewService(port string, getLocalConn func() net.Conn, sendControlMsg func(commands.Command) error) Service {
-	if sendControlMsg == nil {
-		log.Fatal("Error create new service. `sendControlMsg` is nil")
+func NewService(port string, openStream func(commands.Command) (net.Conn, error), availability *Availability, upstream string, route *Route, mirror MirrorMode) Service {
+	if openStream == nil {
+		log.Fatal("Error create new service. `openStream` is nil")
+	}
+	if availability == nil {
+		log.Fatal("Error create new service. `availability` is nil")
+	}
+	if route != nil && upstream == "" {
+		log.Fatal("Error create new service. `upstream` is required for routing requests", "port", port)
+	}
+	if mirror == "" {
+		mirror = MirrorOff
+	}
+	if mirror != MirrorOff && upstream == "" {
+		log.Fatal("Error create new service. `upstream` is required for mirroring", "port", port)
 	}
-	if getLocalConn == nil {
-		log.Fatal("Error create new service. `localConnChan` is nil")
+	if mirror != MirrorOff && route != nil {
+		log.Fatal("Error create new service. Requests cannot be both routed and mirrored", "port", port)
 	}
 	return Service{
-		getLocalConn:   getLocalConn,
-		sendControlMsg: sendControlMsg,
-		logger:         log.WithPrefix("[SERVICE]"),
-		Port:           port,
+		openStream:   openStream,
+		availability: availability,
+		ready:        make(chan struct{}),
+		logger:       log.WithPrefix("[SERVICE]"),
+		Port:         port,
+		Upstream:     upstream,
+		Route:        route,
+		Mirror:       mirror,
 	}
 }
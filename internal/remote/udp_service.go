@@ -0,0 +1,171 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/v4run/reversepf/internal/commands"
+	"github.com/v4run/reversepf/internal/mapping"
+	"github.com/v4run/reversepf/internal/mux"
+)
+
+const udpFlowQueueSize = 64
+
+// UDPService proxies datagrams to the local component. Every peer gets its own flow, which is
+// proxied as a separate stream and is closed after it is idle for IdleTimeout.
+type UDPService struct {
+	openStream   func(commands.Command) (net.Conn, error)
+	availability *Availability
+	flows        map[string]*udpFlow
+	flowsLock    *sync.Mutex
+	ready        chan struct{}
+	logger       *log.Logger
+	Port         string
+	IdleTimeout  time.Duration
+}
+
+type udpFlow struct {
+	peer       net.Addr
+	datagrams  chan []byte
+	lastActive atomic.Int64
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *UDPService) Start() {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("", s.Port))
+	if err != nil {
+		s.logger.Fatal("Error starting listener", "err", err)
+	}
+	s.logger.Info("Ready to accept datagrams", "addr", conn.LocalAddr().String())
+	close(s.ready)
+	buf := make([]byte, mux.MaxDatagramSize)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.logger.Error("Error reading datagram", "err", err)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		flow := s.flowFor(conn, peer)
+		select {
+		case flow.datagrams <- datagram:
+		default:
+			s.logger.Warn("Flow queue full. Dropping datagram", "peer", peer.String())
+		}
+	}
+}
+
+// Ready is closed once the service is listening.
+func (s *UDPService) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *UDPService) flowFor(conn net.PacketConn, peer net.Addr) *udpFlow {
+	s.flowsLock.Lock()
+	defer s.flowsLock.Unlock()
+	if flow, ok := s.flows[peer.String()]; ok {
+		return flow
+	}
+	flow := &udpFlow{
+		peer:      peer,
+		datagrams: make(chan []byte, udpFlowQueueSize),
+	}
+	flow.touch()
+	s.flows[peer.String()] = flow
+	go s.proxyFlow(conn, flow)
+	return flow
+}
+
+func (s *UDPService) proxyFlow(conn net.PacketConn, flow *udpFlow) {
+	peer := flow.peer.String()
+	defer func() {
+		s.flowsLock.Lock()
+		delete(s.flows, peer)
+		s.flowsLock.Unlock()
+	}()
+	command := commands.NewInitCommand(s.Port, mapping.ProtocolUDP, peer, conn.LocalAddr().String())
+	stream, err := s.openStream(command)
+	if errors.Is(err, ErrClientNotConnected) && s.availability.wait() {
+		stream, err = s.openStream(command)
+	}
+	if err != nil {
+		countDialFailure(s.Port+"/"+mapping.ProtocolUDP, err)
+		s.logger.Error("Error opening stream to local component. Dropping flow", "peer", peer, "err", err)
+		return
+	}
+	defer stream.Close()
+	s.logger.Info("New flow established", "peer", peer)
+	label := s.Port + "/" + mapping.ProtocolUDP
+	totalConnections.With(label).Inc()
+	active := activeConnections.With(label)
+	active.Inc()
+	start := time.Now()
+	defer func() {
+		active.Dec()
+		connectionDuration.With(label).Observe(time.Since(start).Seconds())
+	}()
+	in, out := transferredBytes.With(label, "in"), transferredBytes.With(label, "out")
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, mux.MaxDatagramSize)
+		for {
+			datagram, err := mux.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			if _, err := conn.WriteTo(datagram, flow.peer); err != nil {
+				s.logger.Warn("Error sending datagram", "peer", peer, "err", err)
+				continue
+			}
+			out.Add(uint64(len(datagram)))
+		}
+	}()
+	timer := time.NewTimer(s.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case datagram := <-flow.datagrams:
+			flow.touch()
+			in.Add(uint64(len(datagram)))
+			if err := mux.WriteDatagram(stream, datagram); err != nil {
+				s.logger.Warn("Flow closed", "peer", peer, "err", err)
+				return
+			}
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, flow.lastActive.Load()))
+			if idle >= s.IdleTimeout {
+				s.logger.Info("Closing idle flow", "peer", peer)
+				return
+			}
+			timer.Reset(s.IdleTimeout - idle)
+		}
+	}
+}
+
+func NewUDPService(port string, idleTimeout time.Duration, openStream func(commands.Command) (net.Conn, error), availability *Availability) UDPService {
+	if openStream == nil {
+		log.Fatal("Error create new udp service. `openStream` is nil")
+	}
+	if availability == nil {
+		log.Fatal("Error create new udp service. `availability` is nil")
+	}
+	return UDPService{
+		openStream:   openStream,
+		availability: availability,
+		flows:        make(map[string]*udpFlow),
+		flowsLock:    new(sync.Mutex),
+		ready:        make(chan struct{}),
+		logger:       log.WithPrefix("[UDPSERVICE]"),
+		Port:         port,
+		IdleTimeout:  idleTimeout,
+	}
+}
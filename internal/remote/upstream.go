@@ -0,0 +1,44 @@
+package remote
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/v4run/reversepf/internal/mapping"
+)
+
+// ParseUpstreams parses upstreams of the form [SERVICE_PORT=]HOST:PORT and returns the upstream
+// address for each service port. An upstream without a service port is used for all the service
+// ports which do not have an upstream of their own, and is stored with an empty key.
+func ParseUpstreams(specs []string) (map[string]string, error) {
+	upstreams := make(map[string]string)
+	for _, spec := range specs {
+		servicePort, addr, found := strings.Cut(spec, "=")
+		if !found {
+			servicePort, addr = "", spec
+		} else {
+			port, _, err := mapping.ParseServicePort(servicePort)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream %q: %w", spec, err)
+			}
+			servicePort = port
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", spec, err)
+		}
+		if _, ok := upstreams[servicePort]; ok {
+			return nil, fmt.Errorf("upstream for service port %q is specified more than once", servicePort)
+		}
+		upstreams[servicePort] = addr
+	}
+	return upstreams, nil
+}
+
+// UpstreamFor returns the upstream address for the service port, if any.
+func UpstreamFor(upstreams map[string]string, servicePort string) string {
+	if addr, ok := upstreams[servicePort]; ok {
+		return addr
+	}
+	return upstreams[""]
+}
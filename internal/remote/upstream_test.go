@@ -0,0 +1,126 @@
+package remote
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v4run/reversepf/internal/commands"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		want  map[string]string
+		err   string
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "default", specs: []string{"web.default:80"}, want: map[string]string{"": "web.default:80"}},
+		{
+			name:  "per service port",
+			specs: []string{"80=web.default:80", "9090/tcp=metrics.default:9090", "api.default:8080"},
+			want:  map[string]string{"80": "web.default:80", "9090": "metrics.default:9090", "": "api.default:8080"},
+		},
+		{name: "missing port", specs: []string{"80=web.default"}, err: `invalid upstream "80=web.default": address web.default: missing port in address`},
+		{name: "invalid service port", specs: []string{"http=web.default:80"}, err: `invalid upstream "http=web.default:80": invalid service port "http": invalid port "http"`},
+		{name: "duplicate service port", specs: []string{"80=a:80", "80=b:80"}, err: `upstream for service port "80" is specified more than once`},
+		{name: "duplicate default", specs: []string{"a:80", "b:80"}, err: `upstream for service port "" is specified more than once`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUpstreams(tt.specs)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("ParseUpstreams = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseUpstreams = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamFor(t *testing.T) {
+	upstreams := map[string]string{"80": "web.default:80", "": "api.default:8080"}
+	tests := []struct {
+		servicePort string
+		upstreams   map[string]string
+		want        string
+	}{
+		{servicePort: "80", upstreams: upstreams, want: "web.default:80"},
+		{servicePort: "9090", upstreams: upstreams, want: "api.default:8080"},
+		{servicePort: "9090", upstreams: map[string]string{"80": "web.default:80"}, want: ""},
+		{servicePort: "80", upstreams: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.servicePort, func(t *testing.T) {
+			if got := UpstreamFor(tt.upstreams, tt.servicePort); got != tt.want {
+				t.Errorf("UpstreamFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// echoUpstream answers every connection with its name and closes it.
+func echoUpstream(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestServiceFallsBackToUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		upstream string
+		want     string
+	}{
+		{name: "not connected", err: ErrClientNotConnected, upstream: echoUpstream(t, "upstream"), want: "upstream"},
+		{name: "dial failed", err: &DialFailedError{Reason: "connection refused"}, upstream: echoUpstream(t, "upstream"), want: "upstream"},
+		{name: "upstream unreachable", err: ErrClientNotConnected, upstream: closedPort(t), want: httpUnavailableResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openStream := func(commands.Command) (net.Conn, error) { return nil, tt.err }
+			// with an upstream, connections are not held for the local component
+			availability := NewAvailability(time.Minute, 1, FailureActionHTTP, func(time.Duration) bool {
+				t.Error("connection held for the local component")
+				return false
+			})
+			service := NewService("8080", openStream, availability, tt.upstream, nil, MirrorOff)
+			client, server := net.Pipe()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go service.handleConnection(server)
+			read, err := io.ReadAll(client)
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			if string(read) != tt.want {
+				t.Errorf("read %q, want %q", read, tt.want)
+			}
+		})
+	}
+}
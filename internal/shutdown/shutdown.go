@@ -0,0 +1,115 @@
+// Package shutdown runs the cleanup of the local side once, whichever way the process ends.
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Signals are the signals which start a shutdown. SIGHUP is sent when the terminal is closed.
+var Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// Manager runs the registered hooks before the process exits. Hooks run in the reverse order of registration,
+// all within Timeout. A signal received while the hooks run exits immediately.
+type Manager struct {
+	lock    sync.Mutex
+	hooks   []hook
+	once    sync.Once
+	logger  *log.Logger
+	exit    func(int)
+	Timeout time.Duration
+}
+
+type hook struct {
+	name string
+	run  func(context.Context)
+}
+
+func NewManager(timeout time.Duration) *Manager {
+	return &Manager{
+		logger:  log.WithPrefix("[SHUTDOWN]"),
+		exit:    os.Exit,
+		Timeout: timeout,
+	}
+}
+
+// OnShutdown registers a hook. The context given to the hook is done once the timeout is over.
+func (m *Manager) OnShutdown(name string, run func(context.Context)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hooks = append(m.hooks, hook{name: name, run: run})
+}
+
+// HandleSignals shuts down on the first of the Signals, and exits without waiting for the hooks on the next one.
+func (m *Manager) HandleSignals() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, Signals...)
+	go func() {
+		sig := <-sigChan
+		m.logger.Info("Received signal. Shutting down, repeat to exit immediately", "signal", sig)
+		go m.Shutdown(0)
+		sig = <-sigChan
+		m.logger.Warn("Received signal again. Exiting without completing the cleanup", "signal", sig)
+		os.Exit(1)
+	}()
+}
+
+// Recover shuts down with the panic logged if the calling goroutine panics. It must be deferred.
+func (m *Manager) Recover() {
+	if r := recover(); r != nil {
+		m.logger.Error("Panic", "err", fmt.Sprint(r), "stack", string(debug.Stack()))
+		m.Shutdown(2)
+	}
+}
+
+// Go runs f in a new goroutine which shuts down if f panics.
+func (m *Manager) Go(f func()) {
+	go func() {
+		defer m.Recover()
+		f()
+	}()
+}
+
+// Shutdown runs the hooks and exits with the code. Only the first call runs the hooks, later calls block
+// until the process exits.
+func (m *Manager) Shutdown(code int) {
+	m.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+		defer cancel()
+		m.lock.Lock()
+		hooks := m.hooks
+		m.lock.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			m.run(ctx, hooks[i])
+		}
+		m.exit(code)
+	})
+	select {}
+}
+
+// run runs the hook, giving up on it once the context is done. A panicking hook does not stop the others.
+func (m *Manager) run(ctx context.Context, h hook) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				m.logger.Error("Panic in shutdown hook", "hook", h.name, "err", fmt.Sprint(r))
+			}
+		}()
+		h.run(ctx)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.logger.Error("Shutdown timed out", "hook", h.name)
+	}
+}
@@ -0,0 +1,144 @@
+package shutdown
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testManager returns a manager whose exit ends the goroutine shutting down and sends the code to exited.
+func testManager(timeout time.Duration) (*Manager, chan int) {
+	exited := make(chan int, 2)
+	m := NewManager(timeout)
+	m.exit = func(code int) {
+		exited <- code
+		runtime.Goexit()
+	}
+	return m, exited
+}
+
+// waitExit returns the exit code, failing the test if the manager does not exit in time.
+func waitExit(t *testing.T, exited chan int) int {
+	t.Helper()
+	select {
+	case code := <-exited:
+		return code
+	case <-time.After(5 * time.Second):
+		t.Fatal("manager did not exit")
+		return 0
+	}
+}
+
+func TestShutdownRunsHooksInReverseOrder(t *testing.T) {
+	m, exited := testManager(time.Second)
+	var (
+		lock sync.Mutex
+		ran  []string
+	)
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		m.OnShutdown(name, func(context.Context) {
+			lock.Lock()
+			defer lock.Unlock()
+			ran = append(ran, name)
+		})
+	}
+	go m.Shutdown(3)
+	if code := waitExit(t, exited); code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"third", "second", "first"}; !slices.Equal(ran, want) {
+		t.Errorf("hooks ran in order %v, want %v", ran, want)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	m, exited := testManager(50 * time.Millisecond)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	cancelled := make(chan struct{})
+	m.OnShutdown("stuck", func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+		// a hook ignoring its context is given up on
+		<-stuck
+	})
+	start := time.Now()
+	go m.Shutdown(0)
+	waitExit(t, exited)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("exited after %s, want once the timeout is over", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("context of the hook not done at the timeout")
+	}
+}
+
+func TestShutdownHookPanics(t *testing.T) {
+	m, exited := testManager(time.Second)
+	ran := make(chan struct{})
+	m.OnShutdown("last", func(context.Context) { close(ran) })
+	m.OnShutdown("panics", func(context.Context) { panic("boom") })
+	go m.Shutdown(1)
+	if code := waitExit(t, exited); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Error("hook after a panicking hook did not run")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	m, exited := testManager(time.Second)
+	ran := make(chan struct{})
+	m.OnShutdown("cleanup", func(context.Context) { close(ran) })
+	m.Go(func() { panic("boom") })
+	if code := waitExit(t, exited); code != 2 {
+		t.Errorf("exit code = %d, want 2", code)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Error("hooks did not run after the panic")
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	m, exited := testManager(time.Second)
+	var runs int
+	var lock sync.Mutex
+	m.OnShutdown("cleanup", func(context.Context) {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+	})
+	go m.Shutdown(0)
+	waitExit(t, exited)
+	returned := make(chan struct{})
+	go func() {
+		m.Shutdown(1)
+		close(returned)
+	}()
+	// the second call neither runs the hooks again nor exits with its own code, it waits for the exit
+	select {
+	case <-returned:
+		t.Error("second Shutdown returned, want it to block until the process exits")
+	case code := <-exited:
+		t.Errorf("second Shutdown exited with %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if runs != 1 {
+		t.Errorf("hooks ran %d times, want 1", runs)
+	}
+}
@@ -1,9 +1,9 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net"
-	"os"
-	"os/signal"
 )
 
 func GetRandomOpenPort(count int) ([]string, error) {
@@ -28,11 +28,11 @@ func GetRandomOpenPort(count int) ([]string, error) {
 	return ports, nil
 }
 
-func HandleSignals(cb func(), sigs ...os.Signal) {
-	sigChan := make(chan os.Signal, len(sigs))
-	signal.Notify(sigChan, sigs...)
-	go func() {
-		<-sigChan
-		cb()
-	}()
+// GenerateToken returns a random hex encoded token.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }